@@ -5,7 +5,6 @@ import (
 	"io/fs"
 	"os"
 	"path"
-	"strings"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
@@ -14,11 +13,18 @@ import (
 )
 
 func ar(x string) string {
-	return strings.TrimPrefix(path.Clean(x), "/")
+	return Dotify(path.Clean("/" + x))
 }
 
+// AF serves a hackpadfs tree as an afero.Fs. Like BF, files it opens can
+// take whole-file locks from Locks, or DefaultLocks if that is nil.
 type AF struct {
 	fs.FS
+	Locks *Locks
+}
+
+func (b AF) file(f fs.File, name string) afero.File {
+	return newLockedB(b.Locks, f, ar(name))
 }
 
 // Create creates the named file with mode 0666 (before umask), truncating
@@ -26,7 +32,10 @@ type AF struct {
 // be used for I/O; the associated file descriptor has mode O_RDWR.
 func (b AF) Create(filename string) (afero.File, error) {
 	f, err := hackpadfs.Create(b.FS, ar(filename))
-	return B{f}, err
+	if err != nil {
+		return nil, err
+	}
+	return b.file(f, filename), nil
 }
 
 // Open opens the named file for reading. If successful, methods on the
@@ -34,7 +43,10 @@ func (b AF) Create(filename string) (afero.File, error) {
 // mode O_RDONLY.
 func (b AF) Open(filename string) (afero.File, error) {
 	f, err := b.FS.Open(ar(filename))
-	return B{f}, err
+	if err != nil {
+		return nil, err
+	}
+	return b.file(f, filename), nil
 }
 
 // OpenFile is the generalized open call; most users will use Open or Create
@@ -43,7 +55,10 @@ func (b AF) Open(filename string) (afero.File, error) {
 // File can be used for I/O.
 func (b AF) OpenFile(filename string, flag int, perm os.FileMode) (afero.File, error) {
 	f, err := hackpadfs.OpenFile(b.FS, ar(filename), flag, perm)
-	return B{f}, err
+	if err != nil {
+		return nil, err
+	}
+	return b.file(f, filename), nil
 }
 
 // Stat returns a FileInfo describing the named file.
@@ -157,6 +172,22 @@ type A struct {
 	afero.File
 }
 
+// Lock takes a whole-file lock if the afero file can, as those from AF
+// can.
+func (a A) Lock() error {
+	if l, ok := a.File.(interface{ Lock() error }); ok {
+		return l.Lock()
+	}
+	return nil
+}
+
+func (a A) Unlock() error {
+	if l, ok := a.File.(interface{ Unlock() error }); ok {
+		return l.Unlock()
+	}
+	return nil
+}
+
 type FA struct {
 	afero.Afero
 }
@@ -203,7 +234,7 @@ func NewAferoShim(x afero.Fs) FA {
 }
 
 func NewCow(over fs.FS, layer fs.FS) fs.FS {
-	return NewAferoShim(afero.NewCopyOnWriteFs(AF{over}, AF{layer}))
+	return NewAferoShim(afero.NewCopyOnWriteFs(AF{FS: over}, AF{FS: layer}))
 }
 
 var _ fs.FS = FA{}
@@ -0,0 +1,180 @@
+package remount
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/DeedleFake/p9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrAuth = errors.New("authentication failed")
+
+// Authenticator decides whether a 9P client may attach. Each afid from
+// Tauth carries a fresh random nonce, which the client reads from it;
+// the client then proves itself by writing a response, and Check is
+// called with the nonce and everything it wrote once it attaches.
+type Authenticator interface {
+	Check(user, aname string, nonce, resp []byte) error
+}
+
+// SecretAuth is a shared-secret Authenticator. The response a client
+// writes must be the hex HMAC-SHA256 of Challenge(user, aname, nonce)
+// keyed with the secret. The secret never goes over the wire, and since
+// every afid has its own nonce a captured response cannot be replayed.
+// The channel itself is not protected, so anyone in the middle can
+// still take over a session once it is attached.
+type SecretAuth []byte
+
+// Challenge returns the message a client must sign to attach to aname
+// as user, given the nonce it read from its afid.
+func Challenge(user, aname string, nonce []byte) []byte {
+	return []byte("remount 9p auth\n" + user + "\n" + aname + "\n" + string(nonce))
+}
+
+// Respond computes the response a client holding secret should write.
+func (s SecretAuth) Respond(user, aname string, nonce []byte) []byte {
+	m := hmac.New(sha256.New, s)
+	m.Write(Challenge(user, aname, nonce))
+	return []byte(hex.EncodeToString(m.Sum(nil)))
+}
+
+func (s SecretAuth) Check(user, aname string, nonce, resp []byte) error {
+	if len(nonce) == 0 {
+		return ErrAuth
+	}
+	if !hmac.Equal(s.Respond(user, aname, nonce), []byte(strings.TrimSpace(string(resp)))) {
+		return ErrAuth
+	}
+	return nil
+}
+
+// Htpasswd is an Authenticator backed by an htpasswd-style table of
+// user names to password hashes. bcrypt ($2y$ and friends), {SHA} and
+// plain entries are understood; the client writes its password and
+// ignores the nonce, so this is only safe over a protected channel.
+type Htpasswd map[string]string
+
+// LoadHtpasswd parses "user:hash" lines, skipping blanks and comments.
+func LoadHtpasswd(r io.Reader) (Htpasswd, error) {
+	h := Htpasswd{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		u, p, ok := strings.Cut(l, ":")
+		if !ok {
+			return nil, errors.New("malformed htpasswd line")
+		}
+		h[u] = p
+	}
+	return h, s.Err()
+}
+
+func (h Htpasswd) Check(user, aname string, nonce, resp []byte) error {
+	hash, ok := h[user]
+	if !ok {
+		return ErrAuth
+	}
+	pass := strings.TrimRight(string(resp), "\r\n")
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+			return ErrAuth
+		}
+		return nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		ok = subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	default:
+		ok = subtle.ConstantTimeCompare([]byte(hash), []byte(pass)) == 1
+	}
+	if !ok {
+		return ErrAuth
+	}
+	return nil
+}
+
+// maxAuthResp bounds what a client may write to an afid.
+const maxAuthResp = 4096
+
+// authFile is the afid handed out by Dir.Auth. Reading it gives the
+// nonce, and it collects whatever the client writes so Attach can check
+// it.
+type authFile struct {
+	user, aname string
+	nonce       []byte
+	mtx         sync.Mutex
+	resp        []byte
+}
+
+func newAuthFile(user, aname string) (*authFile, error) {
+	n := make([]byte, 16)
+	_, err := rand.Read(n)
+	if err != nil {
+		return nil, err
+	}
+	return &authFile{user: user, aname: aname, nonce: []byte(hex.EncodeToString(n))}, nil
+}
+
+func (a *authFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= int64(len(a.nonce)) {
+		return 0, io.EOF
+	}
+	n := copy(p, a.nonce[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (a *authFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off > maxAuthResp || int64(len(p)) > maxAuthResp-off {
+		return 0, syscall.EFBIG
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if end := int(off) + len(p); end > len(a.resp) {
+		a.resp = append(a.resp, make([]byte, end-len(a.resp))...)
+	}
+	copy(a.resp[off:], p)
+	return len(p), nil
+}
+
+func (a *authFile) Close() error {
+	return nil
+}
+
+func (a *authFile) Readdir() ([]p9.DirEntry, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (a *authFile) check(auth Authenticator, user, aname string) error {
+	if a.user != user || a.aname != aname {
+		return ErrAuth
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return auth.Check(user, aname, a.nonce, a.resp)
+}
+
+var _ p9.File = &authFile{}
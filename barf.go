@@ -1,6 +1,7 @@
 package remount
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"os"
@@ -63,11 +64,14 @@ func (b B) WriteAt(p []byte, off int64) (n int, err error) {
 func (b B) WriteString(s string) (ret int, err error) {
 	return b.Write([]byte(s))
 }
+
+// Lock does nothing, as a bare B has no name to lock by. Files opened
+// through BF lock through its Locks.
 func (b B) Lock() error {
 	return nil
 }
 func (b B) Sync() error {
-	return nil
+	return hackpadfs.SyncFile(b.File)
 }
 func (b B) Unlock() error {
 	return nil
@@ -76,8 +80,52 @@ func (b B) Truncate(size int64) error {
 	return hackpadfs.TruncateFile(b.File, size)
 }
 
+// BF serves a hackpadfs tree as a billy.Filesystem. Files it opens take
+// whole-file locks from Locks, or DefaultLocks if that is nil.
 type BF struct {
 	fs.FS
+	Locks *Locks
+
+	// dir is where a chrooted BF sits in the tree Locks is keyed by.
+	dir string
+}
+
+func (b BF) file(f fs.File, name string) billy.File {
+	return newLockedB(b.Locks, f, path.Join(b.dir, name))
+}
+
+func newLockedB(l *Locks, f fs.File, name string) *lockedB {
+	if l == nil {
+		l = DefaultLocks
+	}
+	return &lockedB{B: B{f}, locks: l, name: name, owner: NewLockOwner()}
+}
+
+// lockedB is a B that can lock the file it was opened from.
+type lockedB struct {
+	B
+	locks *Locks
+	name  string
+	owner uint64
+}
+
+func (b *lockedB) lock() LockRange {
+	return LockRange{Owner: b.owner, End: LockEOF, Write: true, Whole: true}
+}
+
+func (b *lockedB) Lock() error {
+	return b.locks.Lock(context.Background(), b.name, b.lock(), true)
+}
+
+func (b *lockedB) Unlock() error {
+	return b.locks.Unlock(b.name, b.lock())
+}
+
+// Close drops the lock along with the file, as closing an flock'd file
+// does.
+func (b *lockedB) Close() error {
+	b.locks.Unlock(b.name, b.lock())
+	return b.B.Close()
 }
 
 // Create creates the named file with mode 0666 (before umask), truncating
@@ -85,7 +133,10 @@ type BF struct {
 // be used for I/O; the associated file descriptor has mode O_RDWR.
 func (b BF) Create(filename string) (billy.File, error) {
 	f, err := hackpadfs.Create(b.FS, filename)
-	return B{f}, err
+	if err != nil {
+		return nil, err
+	}
+	return b.file(f, filename), nil
 }
 
 // Open opens the named file for reading. If successful, methods on the
@@ -93,7 +144,10 @@ func (b BF) Create(filename string) (billy.File, error) {
 // mode O_RDONLY.
 func (b BF) Open(filename string) (billy.File, error) {
 	f, err := b.FS.Open(filename)
-	return B{f}, err
+	if err != nil {
+		return nil, err
+	}
+	return b.file(f, filename), nil
 }
 
 // OpenFile is the generalized open call; most users will use Open or Create
@@ -102,7 +156,10 @@ func (b BF) Open(filename string) (billy.File, error) {
 // File can be used for I/O.
 func (b BF) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
 	f, err := hackpadfs.OpenFile(b.FS, filename, flag, perm)
-	return B{f}, err
+	if err != nil {
+		return nil, err
+	}
+	return b.file(f, filename), nil
 }
 
 // Stat returns a FileInfo describing the named file.
@@ -183,7 +240,7 @@ func (b BF) Readlink(link string) (string, error) {
 // accessed.
 func (b BF) Chroot(path string) (billy.Filesystem, error) {
 	s, err := hackpadfs.Sub(b.FS, path)
-	return BF{s}, err
+	return BF{FS: s, Locks: b.Locks, dir: b.Join(b.dir, path)}, err
 }
 
 // Root returns the root path of the filesystem.
@@ -19,6 +19,9 @@ type FSF struct {
 	p9.File
 	Path   PathF
 	Offset *int64
+	// Append moves every write to the end of the file, standing in for
+	// O_APPEND, which 9P cannot express.
+	Append bool
 }
 
 type FSS struct {
@@ -32,6 +35,13 @@ func (f FSF) Read(p []byte) (int, error) {
 }
 
 func (f FSF) Write(p []byte) (int, error) {
+	if f.Append {
+		s, err := f.Path.Attachment.Stat(f.Path.Path)
+		if err != nil {
+			return 0, err
+		}
+		*f.Offset = int64(s.Length)
+	}
 	z, err := f.WriteAt(p, *f.Offset)
 	*f.Offset += int64(z)
 	return z, err
@@ -75,16 +85,24 @@ func (f FSW) Open(x string) (hackpadfs.File, error) {
 	var n int64
 	return FSF{File: y, Offset: &n, Path: PathF{Attachment: f.Attachment, Path: x}}, err
 }
+
+// OpenFile opens x with os.OpenFile flags. Attachment.Create is
+// exclusive, so O_CREATE without O_EXCL opens x instead if it exists.
 func (f FSW) OpenFile(x string, flag int, perm hackpadfs.FileMode) (hackpadfs.File, error) {
-	if flag%os.O_CREATE == 0 {
-		y, err := f.Attachment.Open(x, fromOSFlags(flag))
-		var n int64
-		return FSF{File: y, Offset: &n, Path: PathF{Attachment: f.Attachment, Path: x}}, err
+	create := flag&os.O_CREATE != 0
+	if create && flag&os.O_EXCL == 0 {
+		_, err := f.Attachment.Stat(x)
+		create = err != nil
+	}
+	var y p9.File
+	var err error
+	if create {
+		y, err = f.Attachment.Create(x, p9.ModeFromOS(perm), fromOSFlags(flag))
 	} else {
-		y, err := f.Attachment.Create(x, p9.ModeFromOS(perm), fromOSFlags(flag))
-		var n int64
-		return FSF{File: y, Offset: &n, Path: PathF{Attachment: f.Attachment, Path: x}}, err
+		y, err = f.Attachment.Open(x, fromOSFlags(flag))
 	}
+	var n int64
+	return FSF{File: y, Offset: &n, Path: PathF{Attachment: f.Attachment, Path: x}, Append: flag&os.O_APPEND != 0}, err
 }
 
 type FSP struct {
@@ -2,178 +2,1343 @@ package remount
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
+	iofs "io/fs"
 	"log"
+	"math"
+	"os"
+	"os/signal"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
 	"github.com/DeedleFake/p9"
 )
 
+// FuseOptions controls how long the kernel and the in-process stat cache
+// may trust what they were told. Zero leaves bazil's default of a minute;
+// a negative value turns caching off.
+type FuseOptions struct {
+	AttrTTL  time.Duration
+	EntryTTL time.Duration
+	// NegativeTTL is how long a failed lookup is remembered. The kernel
+	// is never told about negative entries, so this only saves the
+	// round trip to the attachment.
+	NegativeTTL time.Duration
+
+	// Inodes numbers files whose attachment leaves DirEntry.Path unset.
+	// Give the attachment and any other adapter over the same tree the
+	// same one to keep numbers consistent between them. Nil means a new
+	// HashInodes.
+	Inodes Inodes
+
+	// Uid and Gid own every file. Nil means the user doing the mount.
+	Uid, Gid *uint32
+
+	// KeepCache lets the kernel keep file pages across opens, which is
+	// only safe when the content never changes. DirectIO bypasses the page
+	// cache instead, for backends that can change under the mount.
+	KeepCache bool
+	DirectIO  bool
+
+	// Locks, if set, takes file locking over from the kernel, so that
+	// locks taken through the mount are seen by every other adapter
+	// sharing it, and the other way round. Lock owners are the kernel's,
+	// which never collide with those from NewLockOwner in practice.
+	Locks *Locks
+
+	// Logger receives errors from the attachment. Nil means the
+	// standard logger.
+	Logger *log.Logger
+}
+
+func ttl(d time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return time.Minute
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
 func FuseFS(r p9.Attachment) fusefs.FS {
-	return &fuseFS{root: r}
+	return NewFuse(r, FuseOptions{})
+}
+
+// ServeFuse serves r on c, which is already mounted at dir. Only the
+// FuseOptions and Context in opts apply; cancelling the context detaches
+// dir and closes c.
+func ServeFuse(c *fuse.Conn, dir string, r p9.Attachment, opts MountOptions) error {
+	f := NewFuse(r, opts.FuseOptions)
+	if opts.Context != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-opts.Context.Done():
+				// Closing c alone would leave dir behind, failing
+				// with ENOTCONN.
+				err := lazyUnmount(dir)
+				if err != nil {
+					f.log.Printf("Error unmounting %s: %v", dir, err)
+				}
+				c.Close()
+			case <-stop:
+			}
+		}()
+	}
+	return f.Serve(c)
+}
+
+// MountOptions configures Mount and MountIpfs.
+type MountOptions struct {
+	FuseOptions
+
+	ReadOnly           bool
+	AllowOther         bool
+	DefaultPermissions bool
+	FSName             string
+	Subtype            string
+	MaxReadahead       uint32
+
+	// Context unmounts the file system when it is cancelled.
+	Context context.Context
+	// UnmountTimeout bounds how long Unmount waits for requests in
+	// flight. Zero means ten seconds.
+	UnmountTimeout time.Duration
+}
+
+func (o MountOptions) fuse() []fuse.MountOption {
+	var m []fuse.MountOption
+	if o.ReadOnly {
+		m = append(m, fuse.ReadOnly())
+	}
+	if o.AllowOther {
+		m = append(m, fuse.AllowOther())
+	}
+	if o.DefaultPermissions {
+		m = append(m, fuse.DefaultPermissions())
+	}
+	if o.FSName != "" {
+		m = append(m, fuse.FSName(o.FSName))
+	}
+	if o.Subtype != "" {
+		m = append(m, fuse.Subtype(o.Subtype))
+	}
+	if o.Locks != nil {
+		m = append(m, fuse.LockingFlock(), fuse.LockingPOSIX())
+	}
+	if o.MaxReadahead != 0 {
+		m = append(m, fuse.MaxReadahead(o.MaxReadahead))
+	}
+	return m
+}
+
+// MountHandle is a file system mounted by Mount.
+type MountHandle struct {
+	// Dir is where the file system is mounted.
+	Dir string
+	// Fuse is the server, for invalidating its caches.
+	Fuse *Fuse
+
+	conn    *fuse.Conn
+	timeout time.Duration
+	done    chan struct{}
+	err     error
+}
+
+// MountFuse mounts r at dir and serves it in the background.
+func MountFuse(r p9.Attachment, dir string, opts MountOptions) (*MountHandle, error) {
+	c, err := fuse.Mount(dir, opts.fuse()...)
+	if err != nil {
+		return nil, err
+	}
+	m := &MountHandle{
+		Dir:     dir,
+		Fuse:    NewFuse(r, opts.FuseOptions),
+		conn:    c,
+		timeout: opts.UnmountTimeout,
+		done:    make(chan struct{}),
+	}
+	if m.timeout == 0 {
+		m.timeout = 10 * time.Second
+	}
+	go func() {
+		m.err = m.Fuse.Serve(c)
+		close(m.done)
+	}()
+	if opts.Context != nil {
+		go func() {
+			select {
+			case <-opts.Context.Done():
+				err := m.Unmount()
+				if err != nil {
+					m.Fuse.log.Printf("Error unmounting %s: %v", dir, err)
+				}
+			case <-m.done:
+			}
+		}()
+	}
+	return m, nil
+}
+
+// Wait blocks until the file system stops being served and returns the
+// error that stopped it.
+func (m *MountHandle) Wait() error {
+	<-m.done
+	return m.err
+}
+
+// Unmount stops taking new requests, gives those in flight the unmount
+// timeout to finish, syncs written handles and unmounts. If the mount is
+// still busy it is detached lazily instead of being left behind. The
+// error that stopped serving is returned along with any of these. If the
+// file system cannot be unmounted at all, it goes back to serving
+// requests.
+func (m *MountHandle) Unmount() error {
+	err := m.Fuse.Drain(m.timeout)
+	uerr := m.unmount(false)
+	if uerr != nil && !m.stopped() {
+		m.Fuse.Resume()
+	}
+	return errors.Join(err, uerr)
+}
+
+func (m *MountHandle) stopped() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
 }
 
-func ServeFuse(c *fuse.Conn, r p9.Attachment) error {
-	return fusefs.Serve(c, FuseFS(r))
+// ForceUnmount detaches the file system at once, without waiting for
+// requests in flight.
+func (m *MountHandle) ForceUnmount() error {
+	return m.unmount(true)
 }
 
-type fuseFS struct {
+func (m *MountHandle) unmount(force bool) error {
+	if !force && fuse.Unmount(m.Dir) == nil {
+		err := m.Wait()
+		return errors.Join(err, m.conn.Close())
+	}
+	err := lazyUnmount(m.Dir)
+	if err != nil {
+		return err
+	}
+	// Whoever still holds the detached mount keeps being served until
+	// they let go; Wait reports when that happens. Their requests were
+	// refused while draining, so admit them again.
+	m.Fuse.Resume()
+	select {
+	case <-m.done:
+		return errors.Join(m.err, m.conn.Close())
+	case <-time.After(m.timeout):
+	}
+	go func() {
+		err := errors.Join(m.Wait(), m.conn.Close())
+		if err != nil {
+			m.Fuse.log.Printf("Error serving detached mount %s: %v", m.Dir, err)
+		}
+	}()
+	return nil
+}
+
+// UnmountOnSignal unmounts m when the process receives one of sigs, or
+// SIGINT or SIGTERM if none are given. A second signal forces it. The
+// returned function stops listening.
+func (m *MountHandle) UnmountOnSignal(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, sigs...)
+	quit := make(chan struct{})
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case <-c:
+		case <-quit:
+			return
+		case <-m.done:
+			return
+		}
+		res := make(chan error, 1)
+		go func() {
+			res <- m.Unmount()
+		}()
+		var err error
+		select {
+		case err = <-res:
+		case <-c:
+			err = m.ForceUnmount()
+		}
+		if err != nil {
+			m.Fuse.log.Printf("Error unmounting %s: %v", m.Dir, err)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+		})
+	}
+}
+
+// Fuse serves a p9.Attachment over FUSE.
+type Fuse struct {
 	root p9.Attachment
+	// inodes backs up attachments that leave DirEntry.Path unset.
+	inodes Inodes
+	opts   FuseOptions
+	uid    uint32
+	gid    uint32
+	log    *log.Logger
+
+	mtx     sync.Mutex
+	stats   map[string]fuseStat
+	nodes   map[string]*fuseNode
+	handles map[*fuseNode2]struct{}
+	srv     *fusefs.Server
+	closing bool
+	reqs    sync.WaitGroup
+}
+
+type fuseStat struct {
+	e   p9.DirEntry
+	err error
+	exp time.Time
 }
 
-func (fs *fuseFS) Root() (fusefs.Node, error) {
-	return &fuseNode{n: fs.root}, nil
+func NewFuse(r p9.Attachment, opts FuseOptions) *Fuse {
+	fs := &Fuse{
+		root:    r,
+		inodes:  opts.Inodes,
+		opts:    opts,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		log:     opts.Logger,
+		stats:   map[string]fuseStat{},
+		nodes:   map[string]*fuseNode{},
+		handles: map[*fuseNode2]struct{}{},
+	}
+	if opts.Uid != nil {
+		fs.uid = *opts.Uid
+	}
+	if opts.Gid != nil {
+		fs.gid = *opts.Gid
+	}
+	if fs.log == nil {
+		fs.log = log.Default()
+	}
+	if fs.inodes == nil {
+		fs.inodes = NewHashInodes()
+	}
+	return fs
+}
+
+// Serve answers kernel requests on c until it is closed.
+func (fs *Fuse) Serve(c *fuse.Conn) error {
+	srv := fusefs.New(c, nil)
+	fs.mtx.Lock()
+	fs.srv = srv
+	fs.mtx.Unlock()
+	return srv.Serve(fs)
+}
+
+func (fs *Fuse) Root() (fusefs.Node, error) {
+	return fs.node(fs.root, ""), nil
+}
+
+func (fs *Fuse) ino(p string, e p9.DirEntry) uint64 {
+	if e.Path != 0 {
+		return e.Path
+	}
+	return fs.inodes.Ino(p)
+}
+
+// node returns the node for p, so that the kernel sees the same node id
+// for a path for as long as it remembers it and invalidations can find it.
+func (fs *Fuse) node(n p9.Attachment, p string) *fuseNode {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if node, ok := fs.nodes[p]; ok {
+		return node
+	}
+	node := &fuseNode{fs: fs, n: n, p: p}
+	fs.nodes[p] = node
+	return node
+}
+
+// openFlags tells the kernel how to cache opened files.
+func (fs *Fuse) openFlags() fuse.OpenResponseFlags {
+	var f fuse.OpenResponseFlags
+	if fs.opts.KeepCache {
+		f |= fuse.OpenKeepCache
+	}
+	if fs.opts.DirectIO {
+		f |= fuse.OpenDirectIO
+	}
+	return f
+}
+
+// handle wraps an open file, keeping track of it so that Drain can flush
+// it.
+func (fs *Fuse) handle(n p9.File, node *fuseNode) *fuseNode2 {
+	h := &fuseNode2{fs: fs, n: n, node: node}
+	fs.mtx.Lock()
+	fs.handles[h] = struct{}{}
+	fs.mtx.Unlock()
+	return h
+}
+
+// enter admits a request, unless Drain has been called. Every admitted
+// request must call exit when it is done.
+func (fs *Fuse) enter() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if fs.closing {
+		return fuse.Errno(syscall.EIO)
+	}
+	fs.reqs.Add(1)
+	return nil
+}
+
+func (fs *Fuse) exit() {
+	fs.reqs.Done()
+}
+
+// Resume admits requests again after a Drain that was not followed by an
+// unmount.
+func (fs *Fuse) Resume() {
+	fs.mtx.Lock()
+	fs.closing = false
+	fs.mtx.Unlock()
+}
+
+// Drain stops admitting requests, waits up to timeout for those already
+// running and then syncs every handle that has been written to.
+func (fs *Fuse) Drain(timeout time.Duration) error {
+	fs.mtx.Lock()
+	fs.closing = true
+	fs.mtx.Unlock()
+
+	var err error
+	done := make(chan struct{})
+	go func() {
+		fs.reqs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = errors.New("timed out waiting for requests in flight")
+	}
+
+	fs.mtx.Lock()
+	hs := make([]*fuseNode2, 0, len(fs.handles))
+	for h := range fs.handles {
+		hs = append(hs, h)
+	}
+	fs.mtx.Unlock()
+	for _, h := range hs {
+		if e := h.sync(false); !errors.Is(e, syscall.ENOSYS) {
+			err = errors.Join(err, e)
+		}
+	}
+	return err
+}
+
+// stat is Attachment.Stat behind the stat cache.
+func (fs *Fuse) stat(n p9.Attachment, p string) (p9.DirEntry, error) {
+	now := time.Now()
+	fs.mtx.Lock()
+	s, ok := fs.stats[p]
+	if ok && !now.Before(s.exp) {
+		delete(fs.stats, p)
+		ok = false
+	}
+	fs.mtx.Unlock()
+	if ok {
+		return s.e, s.err
+	}
+
+	e, err := n.Stat(p)
+	d := ttl(fs.opts.AttrTTL)
+	if err != nil {
+		d = 0
+		if errors.Is(err, iofs.ErrNotExist) {
+			d = ttl(fs.opts.NegativeTTL)
+		}
+	}
+	if d > 0 {
+		fs.mtx.Lock()
+		if len(fs.stats) >= maxStats {
+			fs.evict(now)
+		}
+		fs.stats[p] = fuseStat{e: e, err: err, exp: now.Add(d)}
+		fs.mtx.Unlock()
+	}
+	return e, err
+}
+
+// maxStats bounds the stat cache, for trees too big to remember whole.
+const maxStats = 1 << 16
+
+// evict makes room in the stat cache by dropping expired entries, and then
+// arbitrary ones if that is not enough. fs.mtx must be held.
+func (fs *Fuse) evict(now time.Time) {
+	for k, s := range fs.stats {
+		if !now.Before(s.exp) {
+			delete(fs.stats, k)
+		}
+	}
+	for k := range fs.stats {
+		if len(fs.stats) < maxStats*3/4 {
+			break
+		}
+		delete(fs.stats, k)
+	}
+}
+
+// drop forgets cached stats for p and its parent after a local change.
+func (fs *Fuse) drop(p ...string) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	for _, p := range p {
+		delete(fs.stats, p)
+		delete(fs.stats, aname(path.Dir(p)))
+	}
+}
+
+// move rekeys the nodes and stats under oldp after a rename.
+func (fs *Fuse) move(oldp, newp string) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	for k := range fs.stats {
+		if k == oldp || strings.HasPrefix(k, oldp+"/") {
+			delete(fs.stats, k)
+		}
+	}
+	for k, node := range fs.nodes {
+		if k == oldp || strings.HasPrefix(k, oldp+"/") {
+			delete(fs.nodes, k)
+			node.p = newp + k[len(oldp):]
+			fs.nodes[node.p] = node
+		}
+	}
+}
+
+// Invalidate drops everything cached about p and tells the kernel to do
+// the same. Call it when the tree changes underneath the mount.
+func (fs *Fuse) Invalidate(p string) {
+	p = aname(p)
+	fs.drop(p)
+	fs.mtx.Lock()
+	srv, node, dir := fs.srv, fs.nodes[p], fs.nodes[aname(path.Dir(p))]
+	fs.mtx.Unlock()
+	if srv == nil {
+		return
+	}
+	if node != nil {
+		fs.notify(srv.InvalidateNodeAttr(node))
+		fs.notify(srv.InvalidateNodeData(node))
+	}
+	if dir != nil && p != "" {
+		fs.notify(srv.InvalidateEntry(dir, path.Base(p)))
+	}
+}
+
+func (fs *Fuse) notify(err error) {
+	if err != nil && !errors.Is(err, fuse.ErrNotCached) {
+		fs.log.Printf("Error invalidating kernel cache: %v", err)
+	}
+}
+
+// attr fills in attr from the 9P entry at p. 9P has no ctime, so the
+// mtime stands in for it, and a missing atime falls back to the mtime.
+func (fs *Fuse) attr(p string, e p9.DirEntry, attr *fuse.Attr) {
+	attr.Inode = fs.ino(p, e)
+	attr.Size = e.Length
+	attr.Blocks = (e.Length + 511) / 512
+	attr.BlockSize = 4096
+	attr.Mtime = e.MTime
+	attr.Ctime = e.MTime
+	attr.Atime = e.ATime
+	if attr.Atime.IsZero() {
+		attr.Atime = e.MTime
+	}
+	attr.Mode = e.FileMode.OS()
+	attr.Nlink = 1
+	if e.FileMode&p9.ModeDir != 0 {
+		attr.Nlink = 2
+	}
+	attr.Uid = fs.uid
+	attr.Gid = fs.gid
+}
+
+func direntType(m p9.FileMode) fuse.DirentType {
+	switch {
+	case m&p9.ModeDir != 0:
+		return fuse.DT_Dir
+	case m&p9.ModeSymlink != 0:
+		return fuse.DT_Link
+	case m&p9.ModeSocket != 0:
+		return fuse.DT_Socket
+	case m&p9.ModeNamedPipe != 0:
+		return fuse.DT_FIFO
+	case m&p9.ModeDevice != 0:
+		// 9P does not tell block and character devices apart.
+		return fuse.DT_Block
+	default:
+		return fuse.DT_File
+	}
 }
 
 type fuseNode struct {
-	n p9.Attachment
+	fs *Fuse
+	n  p9.Attachment
+	// p is guarded by fs.mtx, as renames move it.
 	p string
 }
 
+func (node *fuseNode) path() string {
+	node.fs.mtx.Lock()
+	defer node.fs.mtx.Unlock()
+	return node.p
+}
+
 type fuseNode2 struct {
-	n p9.File
+	fs *Fuse
+	n  p9.File
+	// node is the file the handle was opened on, which follows it
+	// through renames.
+	node *fuseNode
+
+	// Directory listing state: ents holds entries from number base on,
+	// and eof is set once n has nothing more to give.
+	mtx  sync.Mutex
+	ents []p9.DirEntry
+	base uint64
+	eof  bool
+
+	dirty bool
 }
 
-func (node *fuseNode) flags(f fuse.OpenFlags) (flags uint8) {
-	switch {
-	case f.IsReadOnly():
-		flags = p9.OREAD
-	case f.IsWriteOnly():
-		flags = p9.OWRITE
-	case f.IsReadWrite():
-		flags = p9.ORDWR
-	}
-	if f&fuse.OpenTruncate != 0 {
-		flags |= p9.OTRUNC
-	}
+// Syncer is implemented by p9.Files that can flush their writes to
+// stable storage.
+type Syncer interface {
+	Sync() error
+}
+
+// DirReader is implemented by p9.Files that can list a directory a chunk
+// at a time, in the manner of fs.ReadDirFile.
+type DirReader interface {
+	ReadDir(n int) ([]p9.DirEntry, error)
+}
+
+const direntChunk = 256
 
-	return flags
+func (node *fuseNode) flags(f fuse.OpenFlags) (flags uint8) {
+	return fromOSFlags(int(f))
 }
 
 func (node *fuseNode) Attr(ctx context.Context, attr *fuse.Attr) error {
-	s, err := node.n.Stat(node.p)
+	s, err := node.fs.stat(node.n, node.path())
 	if err != nil {
-		log.Printf("Error statting file: %v", err)
+		node.fs.log.Printf("Error statting file: %v", err)
 		return err
 	}
 
-	attr.Inode = s.Path
-	attr.Size = s.Length
-	attr.Atime = s.ATime
-	attr.Mtime = s.MTime
-	attr.Mode = s.FileMode.OS()
-
+	attr.Valid = ttl(node.fs.opts.AttrTTL)
+	node.fs.attr(node.path(), s, attr)
 	return nil
 }
 
-func (node *fuseNode) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
-	p := path.Join(node.p, name)
-	_, err := node.n.Stat(p)
+func (node *fuseNode) Lookup(ctx context.Context, req *fuse.LookupRequest, rsp *fuse.LookupResponse) (fusefs.Node, error) {
+	if err := node.fs.enter(); err != nil {
+		return nil, err
+	}
+	defer node.fs.exit()
+	p := path.Join(node.path(), req.Name)
+	_, err := node.fs.stat(node.n, p)
 	if err != nil {
 		return nil, fuse.ENOENT
 	}
 
-	return &fuseNode{n: node.n, p: p}, nil
+	rsp.EntryValid = ttl(node.fs.opts.EntryTTL)
+	return node.fs.node(node.n, p), nil
+}
+
+func (node *fuseNode) Forget() {
+	node.fs.mtx.Lock()
+	defer node.fs.mtx.Unlock()
+	if node.fs.nodes[node.p] == node {
+		delete(node.fs.nodes, node.p)
+	}
 }
 
 func (node *fuseNode) Open(ctx context.Context, req *fuse.OpenRequest, rsp *fuse.OpenResponse) (fusefs.Handle, error) {
-	n, err := node.n.Open(node.p, node.flags(req.Flags))
+	if err := node.fs.enter(); err != nil {
+		return nil, err
+	}
+	defer node.fs.exit()
+	n, err := node.n.Open(node.path(), node.flags(req.Flags))
 	if err != nil {
-		log.Printf("Error opening file: %v", err)
+		node.fs.log.Printf("Error opening file: %v", err)
 		return nil, err
 	}
-	return &fuseNode2{n: n}, nil
+	if !req.Dir {
+		rsp.Flags |= node.fs.openFlags()
+	}
+	return node.fs.handle(n, node), nil
 }
 
-func (node *fuseNode) Create(ctx context.Context, req *fuse.CreateRequest, rsp *fuse.CreateResponse) (fusefs.Handle, error) {
-	n, err := node.n.Create(path.Join(node.p, req.Name), p9.ModeFromOS(req.Mode), node.flags(req.Flags))
+func (node *fuseNode) Create(ctx context.Context, req *fuse.CreateRequest, rsp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	if err := node.fs.enter(); err != nil {
+		return nil, nil, err
+	}
+	defer node.fs.exit()
+	p := path.Join(node.path(), req.Name)
+	n, err := node.n.Create(p, p9.ModeFromOS(req.Mode), node.flags(req.Flags))
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		return nil, err
+		node.fs.log.Printf("Error creating file: %v", err)
+		return nil, nil, err
 	}
-	return &fuseNode2{n: n}, nil
+	node.fs.drop(p)
+	rsp.Flags |= node.fs.openFlags()
+	nd := node.fs.node(node.n, p)
+	return nd, node.fs.handle(n, nd), nil
 }
 
 func (node *fuseNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
-	p := path.Join(node.p, req.Name)
+	if err := node.fs.enter(); err != nil {
+		return nil, err
+	}
+	defer node.fs.exit()
+	p := path.Join(node.path(), req.Name)
 
 	n, err := node.n.Create(p, p9.ModeFromOS(req.Mode)|p9.ModeDir, 0)
 	if err != nil {
-		log.Printf("Error creating directory: %v", err)
+		node.fs.log.Printf("Error creating directory: %v", err)
 		return nil, err
 	}
+	node.fs.drop(p)
+
+	err = n.Close()
+	if err != nil {
+		node.fs.log.Printf("Error closing newly-created directory: %v", err)
+		return nil, err
+	}
+
+	return node.fs.node(node.n, p), nil
+}
+
+// Fsync syncs every open handle on the file, as bazil delivers fsync to
+// the node rather than to the handle it was called on. Handles that
+// cannot sync are skipped if they have nothing written, as ENOSYS would
+// make the kernel stop sending fsync for the whole mount, and fail with
+// EIO if they do.
+func (node *fuseNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	node.fs.mtx.Lock()
+	var hs []*fuseNode2
+	for h := range node.fs.handles {
+		if h.node == node {
+			hs = append(hs, h)
+		}
+	}
+	node.fs.mtx.Unlock()
+
+	var err error
+	for _, h := range hs {
+		e := h.sync(true)
+		if errors.Is(e, syscall.ENOSYS) {
+			if !h.isDirty() {
+				continue
+			}
+			e = fuse.Errno(syscall.EIO)
+		}
+		err = errors.Join(err, e)
+	}
+	if err != nil {
+		node.fs.log.Printf("Error syncing file: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Readlinker is implemented by Attachments that can read symlinks.
+type Readlinker interface {
+	Readlink(p string) (string, error)
+}
+
+// Linker is implemented by Attachments that can create hard links.
+type Linker interface {
+	Link(oldp, newp string) error
+}
+
+// Mknoder is implemented by Attachments that can create device files,
+// FIFOs and sockets with a device number. Others get them through
+// Create, as device 0.
+type Mknoder interface {
+	Mknod(p string, mode os.FileMode, dev int) error
+}
+
+// Renamer is implemented by Attachments that can rename with POSIX
+// semantics, replacing newp if it exists. Others are renamed through
+// WriteStat.
+type Renamer interface {
+	Rename(oldp, newp string) error
+}
+
+// Xattrer is implemented by Attachments that can keep extended
+// attributes.
+type Xattrer interface {
+	GetXattr(p, attr string) ([]byte, error)
+	SetXattr(p, attr string, value []byte, flags int) error
+	ListXattr(p string) ([]string, error)
+	RemoveXattr(p, attr string) error
+}
+
+// noChanges returns StatChanges with every field unset.
+func noChanges() p9.StatChanges {
+	return p9.StatChanges{DirEntry: p9.DirEntry{
+		FileMode: 0xFFFFFFFF,
+		ATime:    time.Unix(-1, 0),
+		MTime:    time.Unix(-1, 0),
+		Length:   0xFFFFFFFFFFFFFFFF,
+	}}
+}
+
+func (node *fuseNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if err := node.fs.enter(); err != nil {
+		return err
+	}
+	defer node.fs.exit()
+	p := path.Join(node.path(), req.Name)
+	err := node.n.Remove(p)
+	if err != nil {
+		node.fs.log.Printf("Error removing file: %v", err)
+		return err
+	}
+	node.fs.drop(p)
+	return nil
+}
+
+func (node *fuseNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	if err := node.fs.enter(); err != nil {
+		return err
+	}
+	defer node.fs.exit()
+	d, ok := newDir.(*fuseNode)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	oldp, newp := path.Join(node.path(), req.OldName), path.Join(d.path(), req.NewName)
+	var err error
+	if r, ok := node.n.(Renamer); ok {
+		err = r.Rename(oldp, newp)
+	} else {
+		c := noChanges()
+		c.EntryName = req.NewName
+		if d.path() != node.path() {
+			c.EntryName = "/" + newp
+		}
+		err = node.n.WriteStat(oldp, c)
+	}
+	if err != nil {
+		node.fs.log.Printf("Error renaming file: %v", err)
+		return err
+	}
+	node.fs.move(oldp, newp)
+	node.fs.drop(oldp, newp)
+	return nil
+}
+
+func (node *fuseNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, rsp *fuse.SetattrResponse) error {
+	if err := node.fs.enter(); err != nil {
+		return err
+	}
+	defer node.fs.exit()
+	c := noChanges()
+	if req.Valid.Mode() {
+		c.FileMode = p9.ModeFromOS(req.Mode)
+	}
+	if req.Valid.Size() {
+		c.DirEntry.Length = req.Size
+	}
+	if req.Valid.Atime() {
+		c.DirEntry.ATime = req.Atime
+	}
+	if req.Valid.AtimeNow() {
+		c.DirEntry.ATime = time.Now()
+	}
+	if req.Valid.Mtime() {
+		c.DirEntry.MTime = req.Mtime
+	}
+	if req.Valid.MtimeNow() {
+		c.DirEntry.MTime = time.Now()
+	}
+	if req.Valid.Uid() {
+		c.DirEntry.UID = strconv.FormatUint(uint64(req.Uid), 10)
+	}
+	if req.Valid.Gid() {
+		c.DirEntry.GID = strconv.FormatUint(uint64(req.Gid), 10)
+	}
+	err := node.n.WriteStat(node.path(), c)
+	if err != nil {
+		node.fs.log.Printf("Error setting attributes: %v", err)
+		return err
+	}
+	node.fs.drop(node.path())
+	return node.Attr(ctx, &rsp.Attr)
+}
 
+func (node *fuseNode) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fusefs.Node, error) {
+	if err := node.fs.enter(); err != nil {
+		return nil, err
+	}
+	defer node.fs.exit()
+	p := path.Join(node.path(), req.NewName)
+	n, err := node.n.Create(p, p9.ModeSymlink|0777, p9.OWRITE)
+	if err != nil {
+		node.fs.log.Printf("Error creating symlink: %v", err)
+		return nil, err
+	}
+	_, err = n.WriteAt([]byte(req.Target), 0)
+	if err != nil {
+		n.Close()
+		node.fs.log.Printf("Error creating symlink: %v", err)
+		return nil, err
+	}
 	err = n.Close()
 	if err != nil {
-		log.Printf("Error closing newly-created directory: %v", err)
+		node.fs.log.Printf("Error creating symlink: %v", err)
 		return nil, err
 	}
+	node.fs.drop(p)
+	return node.fs.node(node.n, p), nil
+}
 
-	return &fuseNode{n: node.n, p: p}, nil
+func (node *fuseNode) Mknod(ctx context.Context, req *fuse.MknodRequest) (fusefs.Node, error) {
+	if err := node.fs.enter(); err != nil {
+		return nil, err
+	}
+	defer node.fs.exit()
+	p := path.Join(node.path(), req.Name)
+	var err error
+	if m, ok := node.n.(Mknoder); ok {
+		err = m.Mknod(p, req.Mode, int(req.Rdev))
+	} else {
+		var f p9.File
+		f, err = node.n.Create(p, p9.ModeFromOS(req.Mode), p9.OREAD)
+		if err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		node.fs.log.Printf("Error creating node: %v", err)
+		return nil, err
+	}
+	node.fs.drop(p)
+	return node.fs.node(node.n, p), nil
 }
 
-func (node *fuseNode2) direntType(m p9.FileMode) fuse.DirentType {
+func (node *fuseNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if err := node.fs.enter(); err != nil {
+		return "", err
+	}
+	defer node.fs.exit()
+	r, ok := node.n.(Readlinker)
+	if !ok {
+		return "", fuse.ENOSYS
+	}
+	s, err := r.Readlink(node.path())
+	if err != nil {
+		node.fs.log.Printf("Error reading symlink: %v", err)
+		return "", err
+	}
+	return s, nil
+}
+
+func (node *fuseNode) Link(ctx context.Context, req *fuse.LinkRequest, old fusefs.Node) (fusefs.Node, error) {
+	if err := node.fs.enter(); err != nil {
+		return nil, err
+	}
+	defer node.fs.exit()
+	l, ok := node.n.(Linker)
+	if !ok {
+		return nil, fuse.ENOSYS
+	}
+	o, ok := old.(*fuseNode)
+	if !ok {
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+	p := path.Join(node.path(), req.NewName)
+	err := l.Link(o.path(), p)
+	if err != nil {
+		node.fs.log.Printf("Error linking file: %v", err)
+		return nil, err
+	}
+	node.fs.drop(o.path(), p)
+	return node.fs.node(node.n, p), nil
+}
+
+// xattrErr gives the kernel the errno it expects from xattr calls.
+func xattrErr(err error) error {
 	switch {
-	case m&p9.ModeDir != 0:
-		return fuse.DT_Dir
-	case m&p9.ModeSymlink != 0:
-		return fuse.DT_Link
-	case m&p9.ModeSocket != 0:
-		return fuse.DT_Socket
-	default:
-		return fuse.DT_Unknown
+	case errors.Is(err, ErrNoXattr), errors.Is(err, syscall.ENODATA):
+		return fuse.ErrNoXattr
+	case errors.Is(err, iofs.ErrExist):
+		return fuse.EEXIST
+	case errors.Is(err, iofs.ErrPermission):
+		return fuse.EPERM
+	case errors.Is(err, syscall.ENOTSUP):
+		return fuse.Errno(syscall.ENOTSUP)
 	}
+	return err
 }
 
+func (node *fuseNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, rsp *fuse.GetxattrResponse) error {
+	x, ok := node.n.(Xattrer)
+	if !ok {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	b, err := x.GetXattr(node.path(), req.Name)
+	if err != nil {
+		return xattrErr(err)
+	}
+	rsp.Xattr = b
+	return nil
+}
+
+func (node *fuseNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, rsp *fuse.ListxattrResponse) error {
+	x, ok := node.n.(Xattrer)
+	if !ok {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	a, err := x.ListXattr(node.path())
+	if err != nil {
+		return xattrErr(err)
+	}
+	rsp.Append(a...)
+	return nil
+}
+
+func (node *fuseNode) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if err := node.fs.enter(); err != nil {
+		return err
+	}
+	defer node.fs.exit()
+	x, ok := node.n.(Xattrer)
+	if !ok {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	err := x.SetXattr(node.path(), req.Name, req.Xattr, int(req.Flags))
+	if err != nil {
+		node.fs.log.Printf("Error setting extended attribute: %v", err)
+		return xattrErr(err)
+	}
+	return nil
+}
+
+func (node *fuseNode) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if err := node.fs.enter(); err != nil {
+		return err
+	}
+	defer node.fs.exit()
+	x, ok := node.n.(Xattrer)
+	if !ok {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	err := x.RemoveXattr(node.path(), req.Name)
+	if err != nil {
+		node.fs.log.Printf("Error removing extended attribute: %v", err)
+		return xattrErr(err)
+	}
+	return nil
+}
+
+var _ fusefs.NodeCreater = &fuseNode{}
+var _ fusefs.NodeRemover = &fuseNode{}
+var _ fusefs.NodeRenamer = &fuseNode{}
+var _ fusefs.NodeSetattrer = &fuseNode{}
+var _ fusefs.NodeSymlinker = &fuseNode{}
+var _ fusefs.NodeMknoder = &fuseNode{}
+var _ fusefs.NodeReadlinker = &fuseNode{}
+var _ fusefs.NodeLinker = &fuseNode{}
+var _ fusefs.NodeRequestLookuper = &fuseNode{}
+var _ fusefs.NodeForgetter = &fuseNode{}
+var _ fusefs.HandleFlusher = &fuseNode2{}
+var _ fusefs.HandleFlockLocker = &fuseNode2{}
+var _ fusefs.HandlePOSIXLocker = &fuseNode2{}
+var _ fusefs.NodeFsyncer = &fuseNode{}
+var _ fusefs.NodeGetxattrer = &fuseNode{}
+var _ fusefs.NodeListxattrer = &fuseNode{}
+var _ fusefs.NodeSetxattrer = &fuseNode{}
+var _ fusefs.NodeRemovexattrer = &fuseNode{}
+
 func (node *fuseNode2) Read(ctx context.Context, req *fuse.ReadRequest, rsp *fuse.ReadResponse) error {
+	if err := node.fs.enter(); err != nil {
+		return err
+	}
+	defer node.fs.exit()
 	if req.Dir {
-		log.Printf("Tried to read file as a directory")
-		return fmt.Errorf("%#v", req)
+		return node.readDir(req, rsp)
 	}
 
 	buf := make([]byte, req.Size)
 	n, err := node.n.ReadAt(buf, req.Offset)
 	rsp.Data = buf[:n]
 	if (err != nil) && !errors.Is(err, io.EOF) {
-		log.Printf("Error reading file: %v", err)
+		node.fs.log.Printf("Error reading file: %v", err)
 		return err
 	}
 	return nil
 }
 
 func (node *fuseNode2) Write(ctx context.Context, req *fuse.WriteRequest, rsp *fuse.WriteResponse) error {
+	if err := node.fs.enter(); err != nil {
+		return err
+	}
+	defer node.fs.exit()
 	n, err := node.n.WriteAt(req.Data, req.Offset)
 	rsp.Size = n
+	node.fs.drop(node.node.path())
+	node.mtx.Lock()
+	node.dirty = true
+	node.mtx.Unlock()
 	if err != nil {
-		log.Printf("Error writing file: %v", err)
+		node.fs.log.Printf("Error writing file: %v", err)
 		return err
 	}
 	return nil
 }
 
-func (node *fuseNode2) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	e, err := node.n.Readdir()
-	if err != nil {
-		log.Printf("Error reading directory: %v", err)
-		return nil, err
+// readDir streams the listing to the kernel. The offset of each dirent
+// is one past its entry number, so the kernel's next offset tells us how
+// much of the buffer it has consumed.
+func (node *fuseNode2) readDir(req *fuse.ReadRequest, rsp *fuse.ReadResponse) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	p := node.node.path()
+	off := uint64(req.Offset)
+	if off < node.base {
+		err := node.rewind()
+		if err != nil {
+			node.fs.log.Printf("Error rewinding directory: %v", err)
+			return err
+		}
 	}
+	for off > node.base+uint64(len(node.ents)) && !node.eof {
+		err := node.more()
+		if err != nil {
+			node.fs.log.Printf("Error reading directory: %v", err)
+			return err
+		}
+	}
+	skip := off - node.base
+	if skip > uint64(len(node.ents)) {
+		skip = uint64(len(node.ents))
+	}
+	node.ents = node.ents[skip:]
+	node.base += skip
 
-	r := make([]fuse.Dirent, len(e))
-	for i := range e {
-		r[i] = fuse.Dirent{
-			Inode: e[i].Path,
-			Type:  node.direntType(e[i].FileMode),
-			Name:  e[i].EntryName,
+	var data []byte
+	for i := 0; ; i++ {
+		if i == len(node.ents) {
+			if node.eof {
+				break
+			}
+			err := node.more()
+			if err != nil {
+				node.fs.log.Printf("Error reading directory: %v", err)
+				return err
+			}
+			if i == len(node.ents) {
+				break
+			}
 		}
+		e := node.ents[i]
+		d := fuse.AppendDirent(nil, fuse.Dirent{
+			Inode: node.fs.ino(path.Join(p, e.EntryName), e),
+			Type:  direntType(e.FileMode),
+			Name:  e.EntryName,
+		})
+		if len(data)+len(d) > req.Size {
+			break
+		}
+		// Overwrite the byte offset AppendDirent filled in.
+		binary.NativeEndian.PutUint64(d[8:16], node.base+uint64(i)+1)
+		data = append(data, d...)
 	}
+	rsp.Data = data
+	return nil
+}
 
-	return r, nil
+// more fetches the next chunk of entries.
+func (node *fuseNode2) more() error {
+	r, ok := node.n.(DirReader)
+	if !ok {
+		e, err := node.n.Readdir()
+		node.ents = append(node.ents, e...)
+		node.eof = true
+		return err
+	}
+	e, err := r.ReadDir(direntChunk)
+	node.ents = append(node.ents, e...)
+	if errors.Is(err, io.EOF) || (err == nil && len(e) == 0) {
+		node.eof = true
+		return nil
+	}
+	return err
+}
+
+// rewind reopens the directory after a seek backwards.
+func (node *fuseNode2) rewind() error {
+	n, err := node.fs.root.Open(node.node.path(), p9.OREAD)
+	if err != nil {
+		return err
+	}
+	node.n.Close()
+	node.n = n
+	node.ents = nil
+	node.base = 0
+	node.eof = false
+	return nil
+}
+
+// Flush syncs the handle if it has been written to and drops the POSIX
+// locks of whoever closed it. Handles that cannot sync are not reported:
+// close promises nothing about stable storage, and ENOSYS would make the
+// kernel stop sending flushes altogether. fsync reports them instead.
+func (node *fuseNode2) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if l := node.fs.opts.Locks; l != nil {
+		l.Unlock(node.node.path(), LockRange{Owner: uint64(req.LockOwner), End: LockEOF})
+	}
+	err := node.sync(false)
+	if errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	if err != nil {
+		node.fs.log.Printf("Error flushing file: %v", err)
+		return err
+	}
+	return nil
 }
 
 func (node *fuseNode2) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if l := node.fs.opts.Locks; l != nil && req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		l.Unlock(node.node.path(), LockRange{Owner: uint64(req.LockOwner), End: LockEOF, Whole: true})
+	}
+	node.fs.mtx.Lock()
+	delete(node.fs.handles, node)
+	node.fs.mtx.Unlock()
+
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
 	return node.n.Close()
 }
+
+// lockRange converts a FUSE lock to a LockRange. flock locks come as
+// whole-file ranges and the kernel's end of file is the largest offset.
+func lockRange(o fuse.LockOwner, l fuse.FileLock, f fuse.LockFlags) LockRange {
+	r := LockRange{
+		Owner: uint64(o),
+		Start: l.Start,
+		End:   l.End,
+		Write: l.Type == fuse.LockWrite,
+		Whole: f&fuse.LockFlock != 0,
+	}
+	if r.End >= math.MaxInt64 {
+		r.End = LockEOF
+	}
+	return r
+}
+
+func (node *fuseNode2) lock(ctx context.Context, req *fuse.LockRequest, wait bool) error {
+	l := node.fs.opts.Locks
+	if l == nil {
+		return fuse.ENOSYS
+	}
+	r := lockRange(req.LockOwner, req.Lock, req.LockFlags)
+	p := node.node.path()
+	if req.Lock.Type == fuse.LockUnlock {
+		return l.Unlock(p, r)
+	}
+	return l.Lock(ctx, p, r, wait)
+}
+
+func (node *fuseNode2) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	return node.lock(ctx, req, false)
+}
+
+func (node *fuseNode2) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	err := node.lock(ctx, (*fuse.LockRequest)(req), true)
+	if errors.Is(err, context.Canceled) {
+		return fuse.Errno(syscall.EINTR)
+	}
+	return err
+}
+
+func (node *fuseNode2) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	return node.lock(ctx, (*fuse.LockRequest)(req), false)
+}
+
+func (node *fuseNode2) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, rsp *fuse.QueryLockResponse) error {
+	l := node.fs.opts.Locks
+	if l == nil {
+		return fuse.ENOSYS
+	}
+	o, busy := l.Query(node.node.path(), lockRange(req.LockOwner, req.Lock, req.LockFlags))
+	if !busy {
+		return nil
+	}
+	rsp.Lock = fuse.FileLock{Start: o.Start, End: o.End, Type: fuse.LockRead, PID: -1}
+	if o.End == LockEOF {
+		rsp.Lock.End = math.MaxInt64
+	}
+	if o.Write {
+		rsp.Lock.Type = fuse.LockWrite
+	}
+	return nil
+}
+
+// sync flushes the handle to stable storage. Unless force is set, this
+// only happens if it has been written to since the last sync. Files that
+// cannot be synced give ENOSYS.
+// isDirty reports whether the handle has writes that were never synced.
+func (node *fuseNode2) isDirty() bool {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	return node.dirty
+}
+
+func (node *fuseNode2) sync(force bool) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	if !node.dirty && !force {
+		return nil
+	}
+	s, ok := node.n.(Syncer)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	err := s.Sync()
+	if err != nil {
+		return err
+	}
+	node.dirty = false
+	return nil
+}
@@ -0,0 +1,171 @@
+package remount
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/DeedleFake/p9"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+	"github.com/ipfs/boxo/files"
+)
+
+// ifFS serves a single IPFS directory node as its root.
+type ifFS struct {
+	files.Directory
+}
+
+func (f ifFS) Open(name string) (fs.File, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return IF{Node: f.Directory, Name: ".", dir: &ifDir{}}, nil
+}
+
+// dirents returns the names and offsets of the dirents in b.
+func dirents(b []byte) (names []string, offs []uint64) {
+	for len(b) >= 24 {
+		off := binary.NativeEndian.Uint64(b[8:16])
+		n := int(binary.NativeEndian.Uint32(b[16:20]))
+		names = append(names, string(b[24:24+n]))
+		offs = append(offs, off)
+		b = b[(24+n+7)&^7:]
+	}
+	return
+}
+
+func TestFuseReadDirIpfs(t *testing.T) {
+	want := []string{"a", "b", "c"}
+	m := map[string]files.Node{}
+	for _, n := range want {
+		m[n] = files.NewBytesFile([]byte(n))
+	}
+	d := Dir{FS: ifFS{files.NewMapDirectory(m)}}
+	f := NewFuse(d, FuseOptions{})
+
+	n, err := d.Open(".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := f.handle(n, f.node(d, "."))
+	defer h.Release(nil, &fuse.ReleaseRequest{})
+
+	var got []string
+	var off int64
+	for i := 0; i < 10; i++ {
+		// Room for one dirent at a time, so the listing takes several
+		// requests.
+		var rsp fuse.ReadResponse
+		err := h.readDir(&fuse.ReadRequest{Dir: true, Offset: off, Size: 32}, &rsp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rsp.Data) == 0 {
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			return
+		}
+		names, offs := dirents(rsp.Data)
+		got = append(got, names...)
+		off = int64(offs[len(offs)-1])
+	}
+	t.Fatalf("no end of directory after 10 reads, got %q", got)
+}
+
+func TestIFReadDirMeta(t *testing.T) {
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "f", []byte("hi"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt := time.Unix(1600000000, 0)
+	err = hackpadfs.Chtimes(m, "f", mt, mt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := hackpadfs.Stat(m, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resolved []string
+	d := IF{
+		Node: files.NewMapDirectory(map[string]files.Node{
+			"f": files.NewBytesStatFile([]byte("hi"), s),
+			"g": files.NewBytesFile([]byte("hi")),
+		}),
+		dir: &ifDir{},
+		child: func(name string) *INSys {
+			resolved = append(resolved, name)
+			return nil
+		},
+	}
+	es, err := d.ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range es {
+		if e.Name() != "f" {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != 0600 || !fi.ModTime().Equal(mt) {
+			t.Errorf("f: got %v %v, want %v %v", fi.Mode(), fi.ModTime(), fs.FileMode(0600), mt)
+		}
+	}
+	if !reflect.DeepEqual(resolved, []string{"g"}) {
+		t.Errorf("resolved %q, want only the entry without metadata", resolved)
+	}
+}
+
+func TestFuseFsyncUnsyncable(t *testing.T) {
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "f", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Dir{FS: m}
+	f := NewFuse(d, FuseOptions{})
+	node := f.node(d, "f")
+	n, err := d.Open("f", p9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := f.handle(n, node)
+	defer h.Release(nil, &fuse.ReleaseRequest{})
+
+	// mem files cannot sync: that is fine until something is written.
+	err = node.Fsync(nil, &fuse.FsyncRequest{})
+	if err != nil {
+		t.Fatalf("Fsync of a clean handle: %v", err)
+	}
+	err = h.Write(nil, &fuse.WriteRequest{Data: []byte("hi")}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node.Fsync(nil, &fuse.FsyncRequest{})
+	if fuse.ToErrno(err) != fuse.Errno(syscall.EIO) {
+		t.Errorf("Fsync of a written handle: got %v, want EIO", err)
+	}
+	err = h.Flush(nil, &fuse.FlushRequest{})
+	if err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+}
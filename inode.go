@@ -0,0 +1,166 @@
+package remount
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hack-pad/hackpadfs"
+)
+
+// Inodes hands out inode numbers for the files of a single mount. The
+// same path must always map to the same number for as long as the
+// Inodes value is alive, and the root is always 1.
+type Inodes interface {
+	Ino(p string) uint64
+	Dev() uint64
+}
+
+var nextDev uint64
+
+func newDev() uint64 {
+	return atomic.AddUint64(&nextDev, 1)
+}
+
+// HashInodes numbers files by hashing their cleaned path. It needs no
+// state, but two paths may in rare cases collide.
+type HashInodes struct {
+	Device uint64
+}
+
+// NewHashInodes returns a HashInodes with a device number that is
+// unique within the process.
+func NewHashInodes() HashInodes {
+	return HashInodes{Device: newDev()}
+}
+
+func inoPath(p string) string {
+	return Dotify(path.Clean("/" + p))
+}
+
+func (h HashInodes) Ino(p string) uint64 {
+	p = inoPath(p)
+	if p == "." {
+		return 1
+	}
+	x := fnv.New64a()
+	x.Write([]byte(p))
+	n := x.Sum64()
+	if n < 2 {
+		n += 2
+	}
+	return n
+}
+
+func (h HashInodes) Dev() uint64 {
+	return h.Device
+}
+
+// TableInodes numbers files sequentially and remembers every path it has
+// seen, so numbers never collide. Memory grows with the number of
+// distinct paths looked up.
+type TableInodes struct {
+	device uint64
+	mtx    sync.Mutex
+	next   uint64
+	m      map[string]uint64
+
+	f   hackpadfs.File
+	err error
+}
+
+func NewTableInodes() *TableInodes {
+	return &TableInodes{device: newDev(), next: 2, m: map[string]uint64{}}
+}
+
+// LoadTableInodes is a TableInodes that appends every number it hands
+// out to the file name inside fs, and starts from what is already there,
+// so files keep their numbers across mounts. The file should live
+// outside the tree being served.
+func LoadTableInodes(fs hackpadfs.FS, name string) (*TableInodes, error) {
+	t := NewTableInodes()
+	b, err := hackpadfs.ReadFile(fs, name)
+	if err != nil && !errors.Is(err, hackpadfs.ErrNotExist) {
+		return nil, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if l == "" {
+			continue
+		}
+		n, q, ok := strings.Cut(l, " ")
+		if !ok {
+			return nil, errors.New("malformed inode table line")
+		}
+		ino, err := strconv.ParseUint(n, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.Unquote(q)
+		if err != nil {
+			return nil, err
+		}
+		t.m[p] = ino
+		if ino >= t.next {
+			t.next = ino + 1
+		}
+	}
+	t.f, err = hackpadfs.OpenFile(fs, name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Err returns the first error hit while saving the table, if any.
+func (t *TableInodes) Err() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.err
+}
+
+// Close closes the file behind a loaded table.
+func (t *TableInodes) Close() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
+
+func (t *TableInodes) Ino(p string) uint64 {
+	p = inoPath(p)
+	if p == "." {
+		return 1
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	n, ok := t.m[p]
+	if !ok {
+		n = t.next
+		t.next++
+		t.m[p] = n
+		if t.f != nil && t.err == nil {
+			_, t.err = hackpadfs.WriteFile(t.f, []byte(strconv.FormatUint(n, 10)+" "+strconv.Quote(p)+"\n"))
+		}
+	}
+	return n
+}
+
+func (t *TableInodes) Dev() uint64 {
+	return t.device
+}
+
+func inodes(i Inodes) Inodes {
+	if i == nil {
+		return HashInodes{}
+	}
+	return i
+}
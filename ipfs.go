@@ -2,18 +2,19 @@ package remount
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	gopath "path"
 
-	"bazil.org/fuse"
-	fusefs "bazil.org/fuse/fs"
 	"github.com/hack-pad/hackpadfs"
 	"github.com/hack-pad/hackpadfs/mem"
 	"github.com/hack-pad/hackpadfs/mount"
@@ -21,9 +22,12 @@ import (
 	// iface "github.com/ipfs/boxo/coreiface"
 
 	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/boxo/ipld/unixfs"
 	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
 	iface "github.com/ipfs/kubo/core/coreiface"
-	"go4.org/readerutil"
+	"github.com/ipfs/kubo/core/coreiface/options"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -31,6 +35,46 @@ type IN struct {
 	name  string
 	size  int64
 	isDir bool
+	meta  *INSys
+}
+
+// INSys is what IN.Sys returns for entries opened by path. Mode and MTime
+// come from the UnixFS 1.5 metadata of the node, and are zero when it has
+// none.
+type INSys struct {
+	CID       cid.Cid
+	Codec     uint64
+	BlockSize int
+	Mode      fs.FileMode
+	MTime     time.Time
+}
+
+// unixfsNode decodes the UnixFS data of n, if it is a dag-pb node.
+func unixfsNode(n ipld.Node) *unixfs.FSNode {
+	d, ok := n.(interface{ Data() []byte })
+	if !ok || n.Cid().Prefix().Codec != cid.DagProtobuf {
+		return nil
+	}
+	u, err := unixfs.FSNodeFromBytes(d.Data())
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// ipldIsDir tells whether n is a UnixFS directory or HAMT shard.
+func ipldIsDir(n ipld.Node) bool {
+	u := unixfsNode(n)
+	return u != nil && u.IsDir()
+}
+
+func ipldMeta(n ipld.Node) *INSys {
+	c := n.Cid()
+	s := &INSys{CID: c, Codec: c.Prefix().Codec, BlockSize: len(n.RawData())}
+	if u := unixfsNode(n); u != nil {
+		s.Mode, s.MTime = u.Mode()&^fs.ModeType, u.ModTime()
+	}
+	return s
 }
 
 func (i IN) Name() string {
@@ -40,27 +84,115 @@ func (i IN) Size() int64 {
 	return i.size
 } // length in bytes for regular files; system-dependent for others
 func (i IN) Mode() fs.FileMode {
-	var m fs.FileMode
-	m = 0777
+	// UnixFS defaults, for nodes without a mode.
+	m := fs.FileMode(0644)
 	if i.isDir {
-		m |= fs.ModeDir
+		m = 0755 | fs.ModeDir
+	}
+	if i.meta != nil && i.meta.Mode != 0 {
+		m = m&fs.ModeType | i.meta.Mode
 	}
 	return m
 } // file mode bits
 func (i IN) ModTime() time.Time {
-	return time.Now()
+	if i.meta != nil && !i.meta.MTime.IsZero() {
+		return i.meta.MTime
+	}
+	return time.Unix(0, 0)
 } // modification time
 func (i IN) IsDir() bool {
 	return i.isDir
 } // abbreviation for Mode().IsDir()
 func (i IN) Sys() any {
-	return nil
+	if i.meta == nil {
+		return nil
+	}
+	return i.meta
 } // underlying data source (can return nil)
 
 type IF struct {
 	files.Node
 	Name string
-	Rec  func() IF
+	at   *ifAt
+	meta *INSys
+	// child looks up the metadata of an entry of a directory.
+	child func(name string) *INSys
+	dir   *ifDir
+}
+
+// ifDir is where a directory handle is in its listing.
+type ifDir struct {
+	it   files.DirIterator
+	done bool
+}
+
+// ifAt serves ReadAt for one open file from a pool of seekable UnixFS
+// readers, so that reads at different offsets neither start over from
+// the beginning nor wait on each other.
+type ifAt struct {
+	open   func() (files.File, error)
+	mtx    sync.Mutex
+	idle   []files.File
+	closed bool
+}
+
+const ifAtIdle = 4
+
+func (a *ifAt) get() (files.File, error) {
+	a.mtx.Lock()
+	if a.closed {
+		a.mtx.Unlock()
+		return nil, fs.ErrClosed
+	}
+	if n := len(a.idle); n > 0 {
+		f := a.idle[n-1]
+		a.idle = a.idle[:n-1]
+		a.mtx.Unlock()
+		return f, nil
+	}
+	a.mtx.Unlock()
+	return a.open()
+}
+
+// put returns f to the pool, or closes it if the pool is full or the
+// file has been closed since f was taken.
+func (a *ifAt) put(f files.File) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if !a.closed && len(a.idle) < ifAtIdle {
+		a.idle = append(a.idle, f)
+		return
+	}
+	f.Close()
+}
+
+func (a *ifAt) ReadAt(b []byte, off int64) (int, error) {
+	f, err := a.get()
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	n, err := io.ReadFull(f, b)
+	a.put(f)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (a *ifAt) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for _, f := range a.idle {
+		f.Close()
+	}
+	a.idle = nil
+	a.closed = true
+	return nil
 }
 
 func (i IF) Stat() (os.FileInfo, error) {
@@ -69,7 +201,7 @@ func (i IF) Stat() (os.FileInfo, error) {
 		return nil, err
 	}
 	_, o := i.Node.(files.Directory)
-	return IN{size: s, isDir: o, name: i.Name}, nil
+	return IN{size: s, isDir: o, name: i.Name, meta: i.meta}, nil
 }
 
 func (i IF) Read(x []byte) (int, error) {
@@ -81,25 +213,58 @@ func (i IF) Read(x []byte) (int, error) {
 }
 
 func (i IF) ReadAt(b []byte, off int64) (n int, err error) {
-	return readerutil.NewBufferingReaderAt(i.Rec()).ReadAt(b, off)
+	if _, ok := i.Node.(files.File); !ok || i.at == nil {
+		return 0, fmt.Errorf("not supported")
+	}
+	return i.at.ReadAt(b, off)
 }
 
+func (i IF) Close() error {
+	if i.at != nil {
+		i.at.Close()
+	}
+	return i.Node.Close()
+}
+
+// ReadDir lists the directory in the manner of fs.ReadDirFile, carrying
+// on from where the previous call stopped.
 func (i IF) ReadDir(n int) ([]fs.DirEntry, error) {
 	f, ok := i.Node.(files.Directory)
-	if !ok {
+	if !ok || i.dir == nil {
 		return nil, fmt.Errorf("not supported")
 	}
+	d := i.dir
+	if d.it == nil {
+		d.it = f.Entries()
+	}
 	x := []fs.DirEntry{}
-	it := f.Entries()
-	for it.Next() {
-		name := it.Name()
-		file := it.Node()
+	for !d.done && (n <= 0 || len(x) < n) {
+		if !d.it.Next() {
+			d.done = true
+			if err := d.it.Err(); err != nil {
+				return x, err
+			}
+			break
+		}
+		name := d.it.Name()
+		file := d.it.Node()
 		s, err := file.Size()
 		if err != nil {
-			return nil, err
+			return x, err
 		}
 		_, o := file.(files.Directory)
-		x = append(x, fs.FileInfoToDirEntry(IN{name: name, size: s, isDir: o}))
+		in := IN{name: name, size: s, isDir: o}
+		// Nodes carry their UnixFS metadata; only resolve the entry
+		// when it has none.
+		if m, t := file.Mode()&^fs.ModeType, file.ModTime(); m != 0 || !t.IsZero() {
+			in.meta = &INSys{Mode: m, MTime: t}
+		} else if i.child != nil {
+			in.meta = i.child(name)
+		}
+		x = append(x, fs.FileInfoToDirEntry(in))
+	}
+	if n > 0 && len(x) == 0 {
+		return nil, io.EOF
 	}
 	return x, nil
 }
@@ -111,11 +276,35 @@ type I struct {
 	Ctx context.Context
 }
 
+// ipath maps a path in I to an IPFS path. Its first element is a CID,
+// "ipfs" or "ipns" followed by a CID or name, or a DNSLink domain.
+func ipath(x string) (path.Path, error) {
+	x = strings.Trim(x, "/")
+	first := strings.SplitN(x, "/", 2)[0]
+	switch {
+	case first == "ipfs" || first == "ipns":
+		return path.NewPath("/" + x)
+	case strings.Contains(first, "."):
+		// CIDs never contain dots, domains always do.
+		return path.NewPath("/ipns/" + x)
+	}
+	return path.NewPath("/ipfs/" + x)
+}
+
 func (i I) Open(x string) (fs.File, error) {
-	if x == "" {
-		return os.Open("/tmp/portal-ipfs-shim")
+	switch strings.Trim(x, "/") {
+	case "", ".":
+		return &IR{I: i, name: ".", pins: true}, nil
+	case "ipfs":
+		return &IR{I: i, name: "ipfs", pins: true}, nil
+	case "ipns":
+		return &IR{I: i, name: "ipns"}, nil
+	}
+	p, err := ipath(x)
+	if err != nil {
+		return nil, err
 	}
-	p, err := path.NewPath("/ipfs/" + x)
+	nd, err := i.ResolveNode(context.Background(), p)
 	if err != nil {
 		return nil, err
 	}
@@ -123,15 +312,109 @@ func (i I) Open(x string) (fs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	var r func() IF
-	r = func() IF {
-		return IF{f, gopath.Base(x), r}
+	at := &ifAt{open: func() (files.File, error) {
+		n, err := i.Unixfs().Get(context.Background(), p)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := n.(files.File)
+		if !ok {
+			n.Close()
+			return nil, fmt.Errorf("not a file")
+		}
+		return f, nil
+	}}
+	child := func(name string) *INSys {
+		c, err := path.Join(p, name)
+		if err != nil {
+			return nil
+		}
+		n, err := i.ResolveNode(context.Background(), c)
+		if err != nil {
+			return nil
+		}
+		return ipldMeta(n)
 	}
-	return r(), nil
+	return IF{f, gopath.Base(x), at, ipldMeta(nd), child, &ifDir{}}, nil
 }
 
 var _ fs.FS = I{}
 
+// IR is a directory of I with no node behind it: the root and the ipfs
+// directory list the pinned CIDs, and the ipns directory is empty. Their
+// children are resolved on open whether or not they are listed.
+type IR struct {
+	I
+	name string
+	pins bool
+
+	ents []fs.DirEntry
+	done bool
+}
+
+func (r *IR) Stat() (fs.FileInfo, error) {
+	return IN{name: r.name, isDir: true}, nil
+}
+
+func (r *IR) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: r.name, Err: syscall.EISDIR}
+}
+
+func (r *IR) Close() error {
+	return nil
+}
+
+func (r *IR) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !r.done {
+		r.ents = r.list()
+		r.done = true
+	}
+	if n <= 0 {
+		e := r.ents
+		r.ents = nil
+		return e, nil
+	}
+	if len(r.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(r.ents) {
+		n = len(r.ents)
+	}
+	e := r.ents[:n]
+	r.ents = r.ents[n:]
+	return e, nil
+}
+
+// list returns the pinned roots, or nothing if pins cannot be listed.
+func (r *IR) list() []fs.DirEntry {
+	if !r.pins {
+		return nil
+	}
+	ch, err := r.Pin().Ls(r.ctx(), options.Pin.Ls.Recursive())
+	if err != nil {
+		return nil
+	}
+	var e []fs.DirEntry
+	for p := range ch {
+		if p.Err() != nil {
+			continue
+		}
+		c := p.Path().RootCid()
+		in := IN{name: c.String()}
+		if nd, err := r.ResolveNode(r.ctx(), p.Path()); err == nil {
+			in.isDir = ipldIsDir(nd)
+			in.meta = ipldMeta(nd)
+		}
+		e = append(e, fs.FileInfoToDirEntry(in))
+	}
+	sort.Slice(e, func(a, b int) bool {
+		return e[a].Name() < e[b].Name()
+	})
+	return e
+}
+
+var _ fs.ReadDirFile = &IR{}
+
 type N struct {
 	fs.File
 	FS   fs.FS
@@ -146,53 +429,186 @@ func (n N) Size() (int64, error) {
 	return s.Size(), nil
 }
 
+func (n N) Mode() fs.FileMode {
+	s, err := hackpadfs.Stat(n.FS, n.Name)
+	if err != nil {
+		return 0
+	}
+	return s.Mode()
+}
+
+func (n N) ModTime() time.Time {
+	s, err := hackpadfs.Stat(n.FS, n.Name)
+	if err != nil {
+		return time.Time{}
+	}
+	return s.ModTime()
+}
+
 var _ files.Node = N{}
 
+// IpfsOpen is how many files Ipfs keeps open at once.
+const IpfsOpen = 16
+
+// Ipfs returns y inside x as a lazy UnixFS node. Directories are listed
+// when iterated and their files opened one at a time in sorted order, so
+// an import only holds the directories on its current path in memory.
 func Ipfs(x fs.FS, y string) (files.Node, error) {
+	return IpfsLimit(x, y, IpfsOpen)
+}
+
+// IpfsLimit is Ipfs with at most n files open at once. Opening one more
+// waits for another to be closed.
+func IpfsLimit(x fs.FS, y string, n int) (files.Node, error) {
+	if n <= 0 {
+		n = 1
+	}
+	if y == "" {
+		y = "."
+	}
+	t := &ipfsTree{fs: x, sem: make(chan struct{}, n)}
 	s, err := hackpadfs.Stat(x, y)
 	if err != nil {
 		return nil, fmt.Errorf("stat: %w", err)
 	}
-	if !s.IsDir() {
-		o, err := x.Open(y)
-		if err != nil {
-			return nil, err
-		}
-		// s, err := o.Stat()
-		// if err != nil {
-		// 	o.Close()
-		// 	return nil, err
-		// }
-		return files.NewReaderFile(o), nil
-	}
-	// defer o.Close()
-	r, err := hackpadfs.ReadDir(x, y)
+	return t.node(y, s)
+}
+
+type ipfsTree struct {
+	fs  fs.FS
+	sem chan struct{}
+}
+
+func (t *ipfsTree) node(y string, s fs.FileInfo) (files.Node, error) {
+	if s.IsDir() {
+		return &ipfsDir{t, y, s}, nil
+	}
+	t.sem <- struct{}{}
+	o, err := t.fs.Open(y)
 	if err != nil {
+		<-t.sem
 		return nil, err
 	}
-	m := map[string]files.Node{}
-	var mtx sync.Mutex
-	var g errgroup.Group
-	for _, s := range r {
-		s := s
-		g.Go(func() error {
-			z := y + "/" + s.Name()
-			n, err := Ipfs(x, z)
-			if err != nil {
-				return fmt.Errorf("%s/%w", s.Name(), err)
-			}
-			mtx.Lock()
-			defer mtx.Unlock()
-			m[s.Name()] = n
+	return files.NewReaderStatFile(&ipfsFile{File: o, sem: t.sem}, s), nil
+}
+
+// ipfsFile gives its slot back when closed.
+type ipfsFile struct {
+	fs.File
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (f *ipfsFile) Close() (err error) {
+	f.once.Do(func() {
+		err = f.File.Close()
+		<-f.sem
+	})
+	return
+}
+
+type ipfsDir struct {
+	t *ipfsTree
+	y string
+	s fs.FileInfo
+}
+
+func (d *ipfsDir) Mode() fs.FileMode {
+	return d.s.Mode()
+}
+
+func (d *ipfsDir) ModTime() time.Time {
+	return d.s.ModTime()
+}
+
+func (d *ipfsDir) Close() error {
+	return nil
+}
+
+// Size walks the whole tree, so it is only worth calling for progress.
+func (d *ipfsDir) Size() (int64, error) {
+	var n int64
+	err := fs.WalkDir(d.t.fs, d.y, func(_ string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
 			return nil
-		})
+		}
+		s, err := e.Info()
+		if err != nil {
+			return err
+		}
+		n += s.Size()
+		return nil
+	})
+	return n, err
+}
+
+func (d *ipfsDir) Entries() files.DirIterator {
+	return &ipfsIter{d: d}
+}
+
+type ipfsIter struct {
+	d    *ipfsDir
+	ents []fs.DirEntry
+	read bool
+	cur  files.Node
+	name string
+	err  error
+}
+
+func (it *ipfsIter) Name() string {
+	return it.name
+}
+
+func (it *ipfsIter) Node() files.Node {
+	return it.cur
+}
+
+func (it *ipfsIter) Err() error {
+	return it.err
+}
+
+// Next closes the previous entry, in case the consumer did not, so that
+// its slot is free for the next one.
+func (it *ipfsIter) Next() bool {
+	if it.cur != nil {
+		it.cur.Close()
+		it.cur = nil
+	}
+	if it.err != nil {
+		return false
+	}
+	if !it.read {
+		// hackpadfs.ReadDir sorts by name.
+		it.ents, it.err = hackpadfs.ReadDir(it.d.t.fs, it.d.y)
+		it.read = true
+		if it.err != nil {
+			return false
+		}
+	}
+	if len(it.ents) == 0 {
+		return false
+	}
+	e := it.ents[0]
+	it.ents[0] = nil
+	it.ents = it.ents[1:]
+	z := gopath.Join(it.d.y, e.Name())
+	s, err := hackpadfs.Stat(it.d.t.fs, z)
+	if err == nil {
+		it.cur, err = it.d.t.node(z, s)
 	}
-	err = g.Wait()
 	if err != nil {
-		return nil, err
+		it.err = fmt.Errorf("%s/%w", e.Name(), err)
+		return false
 	}
-	return files.NewMapDirectory(m), nil
+	it.name = e.Name()
+	return true
 }
+
+var _ files.Directory = &ipfsDir{}
+
 func Clone(x fs.FS, dx fs.FS, y, dy string) error {
 	s, err := hackpadfs.Stat(x, y)
 	if err != nil {
@@ -224,8 +640,8 @@ func Clone(x fs.FS, dx fs.FS, y, dy string) error {
 	for _, s := range r {
 		s := s
 		g.Go(func() error {
-			z := y + "/" + s.Name()
-			dz := dy + "/" + s.Name()
+			z := gopath.Join(y, s.Name())
+			dz := gopath.Join(dy, s.Name())
 			err := Clone(x, dx, z, dz)
 			if err != nil {
 				return fmt.Errorf("%s/%w", s.Name(), err)
@@ -246,7 +662,7 @@ func (i I) Push(x fs.FS, y string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	u, err := i.Unixfs().Add(i.Ctx, n)
+	u, err := i.Unixfs().Add(i.Ctx, n, options.Unixfs.PreserveMode(true), options.Unixfs.PreserveMtime(true))
 	if err != nil {
 		return "", err
 	}
@@ -274,35 +690,32 @@ func NewDir(i I, m map[string]string) (string, error) {
 	}
 	return i.Push(fs, "")
 }
-func Mount(j fs.FS, p string) (func() error, error) {
-	f, err := fuse.Mount(p)
-	if err != nil {
-		return nil, err
+func Mount(j fs.FS, p string, opts MountOptions) (*MountHandle, error) {
+	d := Dir{FS: j, Inodes: opts.inodes()}
+	return MountFuse(d, p, opts)
+}
+
+// inodes returns opts.Inodes, first setting it to a new HashInodes if it
+// is nil, so that the mount and its Dir share it.
+func (opts *MountOptions) inodes() Inodes {
+	if opts.Inodes == nil {
+		opts.Inodes = NewHashInodes()
 	}
-	var g errgroup.Group
-	g.Go(func() error {
-		return fusefs.Serve(f, FuseFS(Dir{j}))
-	})
-	return func() error {
-		err := f.Close()
-		if err != nil {
-			return err
-		}
-		g.Wait()
-		err = fuse.Unmount(p)
-		if err != nil {
-			return err
-		}
-		return nil
-	}, nil
+	return opts.Inodes
 }
 
-func MountIpfs(x I, i, p string) (func() error, error) {
+// MountIpfs mounts the content under /ipfs/i. As that content is
+// immutable, the kernel is told to keep its pages cached between opens
+// unless opts asks for direct IO. Each file's CID is exposed as the
+// XattrCID extended attribute.
+func MountIpfs(x I, i, p string, opts MountOptions) (*MountHandle, error) {
 	s, err := hackpadfs.Sub(x, i)
 	if err != nil {
 		return nil, err
 	}
-	return Mount(s, p)
+	opts.KeepCache = !opts.DirectIO
+	d := Dir{FS: s, Inodes: opts.inodes(), Xattrs: SubXattrs{x, i}}
+	return MountFuse(d, p, opts)
 }
 
 func Patch(i I, x string, f func(*mount.FS) error) (string, error) {
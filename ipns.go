@@ -0,0 +1,225 @@
+package remount
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	gopath "path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/kubo/core/coreiface/options"
+)
+
+func (i I) ctx() context.Context {
+	if i.Ctx == nil {
+		return context.Background()
+	}
+	return i.Ctx
+}
+
+// IPNS serves the tree an IPNS name points to. The name is resolved on
+// open, at most once per Interval; zero resolves it every time.
+type IPNS struct {
+	I
+	// Name is what follows /ipns/: a key, peer ID or DNSLink domain.
+	Name     string
+	Interval time.Duration
+
+	mtx sync.Mutex
+	cid string
+	at  time.Time
+}
+
+func NewIPNS(i I, name string, interval time.Duration) *IPNS {
+	return &IPNS{I: i, Name: strings.TrimPrefix(name, "/ipns/"), Interval: interval}
+}
+
+// Resolve returns the CID the name currently points to.
+func (n *IPNS) Resolve() (string, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.cid != "" && time.Since(n.at) < n.Interval {
+		return n.cid, nil
+	}
+	p, err := n.I.Name().Resolve(n.ctx(), "/ipns/"+n.Name)
+	if err != nil {
+		return "", err
+	}
+	n.cid, n.at = strings.TrimPrefix(p.String(), "/ipfs/"), time.Now()
+	return n.cid, nil
+}
+
+// set points the name at c without asking the network, after publishing.
+func (n *IPNS) set(c string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.cid, n.at = c, time.Now()
+}
+
+func (n *IPNS) Open(x string) (fs.File, error) {
+	c, err := n.Resolve()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: x, Err: err}
+	}
+	return n.I.Open(gopath.Join(c, x))
+}
+
+var _ fs.FS = &IPNS{}
+
+// WritableIPNS is an IPNS tree with a copy-on-write layer on top. Changes
+// stay local until Commit publishes them under Key.
+type WritableIPNS struct {
+	*IPNS
+	// Key is the keystore key the name is published with.
+	Key string
+
+	// cmtx is held by Commit while it pushes, and shared by everything
+	// that changes the layer.
+	cmtx sync.RWMutex
+	cow  fs.FS
+
+	rmtx sync.Mutex
+	root string
+}
+
+// NewWritableIPNS resolves the name once and layers over that CID, so the
+// tree under local edits does not change when the name moves.
+func NewWritableIPNS(n *IPNS, key string) (*WritableIPNS, error) {
+	c, err := n.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	m, err := mem.NewFS()
+	if err != nil {
+		return nil, err
+	}
+	w := &WritableIPNS{IPNS: n, Key: key, root: c}
+	w.cow = NewCow(ipnsRoot{w}, m)
+	return w, nil
+}
+
+// ipnsRoot is the tree as last committed. Commit only moves it: the layer
+// stays on top, so files opened before a commit keep writing where the
+// tree, and the next commit, can see them.
+type ipnsRoot struct {
+	w *WritableIPNS
+}
+
+func (r ipnsRoot) Open(name string) (fs.File, error) {
+	r.w.rmtx.Lock()
+	c := r.w.root
+	r.w.rmtx.Unlock()
+	return r.w.I.Open(gopath.Join(c, name))
+}
+
+// Commit pushes the tree with its local changes, publishes it under Key
+// and moves the layer onto the result. It returns the new CID.
+func (w *WritableIPNS) Commit() (string, error) {
+	w.cmtx.Lock()
+	defer w.cmtx.Unlock()
+	c, err := w.I.Push(w.cow, ".")
+	if err != nil {
+		return "", err
+	}
+	p, err := path.NewPath("/ipfs/" + c)
+	if err != nil {
+		return "", err
+	}
+	_, err = w.I.Name().Publish(w.ctx(), p, options.Name.Key(w.Key))
+	if err != nil {
+		return "", err
+	}
+	w.IPNS.set(c)
+	w.rmtx.Lock()
+	w.root = c
+	w.rmtx.Unlock()
+	return c, nil
+}
+
+// ipnsFile writes under cmtx, so that Commit never pushes half a write.
+type ipnsFile struct {
+	B
+	w *WritableIPNS
+}
+
+func (f ipnsFile) Write(p []byte) (int, error) {
+	f.w.cmtx.RLock()
+	defer f.w.cmtx.RUnlock()
+	return f.B.Write(p)
+}
+
+func (f ipnsFile) WriteAt(p []byte, off int64) (int, error) {
+	f.w.cmtx.RLock()
+	defer f.w.cmtx.RUnlock()
+	return f.B.WriteAt(p, off)
+}
+
+func (f ipnsFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f ipnsFile) Truncate(size int64) error {
+	f.w.cmtx.RLock()
+	defer f.w.cmtx.RUnlock()
+	return f.B.Truncate(size)
+}
+
+func (w *WritableIPNS) Open(name string) (fs.File, error) {
+	return w.cow.Open(name)
+}
+
+func (w *WritableIPNS) OpenFile(name string, flag int, perm fs.FileMode) (hackpadfs.File, error) {
+	w.cmtx.RLock()
+	defer w.cmtx.RUnlock()
+	f, err := hackpadfs.OpenFile(w.cow, name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return ipnsFile{B{f}, w}, nil
+}
+
+func (w *WritableIPNS) Stat(name string) (fs.FileInfo, error) {
+	return hackpadfs.Stat(w.cow, name)
+}
+
+func (w *WritableIPNS) Mkdir(name string, perm fs.FileMode) error {
+	w.cmtx.RLock()
+	defer w.cmtx.RUnlock()
+	return hackpadfs.Mkdir(w.cow, name, perm)
+}
+
+func (w *WritableIPNS) Remove(name string) error {
+	w.cmtx.RLock()
+	defer w.cmtx.RUnlock()
+	return hackpadfs.Remove(w.cow, name)
+}
+
+func (w *WritableIPNS) Rename(oldname, newname string) error {
+	w.cmtx.RLock()
+	defer w.cmtx.RUnlock()
+	return hackpadfs.Rename(w.cow, oldname, newname)
+}
+
+func (w *WritableIPNS) Chmod(name string, mode fs.FileMode) error {
+	w.cmtx.RLock()
+	defer w.cmtx.RUnlock()
+	return hackpadfs.Chmod(w.cow, name, mode)
+}
+
+func (w *WritableIPNS) Chtimes(name string, atime, mtime time.Time) error {
+	w.cmtx.RLock()
+	defer w.cmtx.RUnlock()
+	return hackpadfs.Chtimes(w.cow, name, atime, mtime)
+}
+
+var _ hackpadfs.OpenFileFS = &WritableIPNS{}
+var _ hackpadfs.MkdirFS = &WritableIPNS{}
+var _ hackpadfs.RemoveFS = &WritableIPNS{}
+var _ hackpadfs.RenameFS = &WritableIPNS{}
+var _ hackpadfs.ChmodFS = &WritableIPNS{}
+var _ hackpadfs.ChtimesFS = &WritableIPNS{}
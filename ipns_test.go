@@ -0,0 +1,234 @@
+package remount
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	gopath "path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipns"
+	"github.com/ipfs/boxo/path"
+	ipld "github.com/ipfs/go-ipld-format"
+	iface "github.com/ipfs/kubo/core/coreiface"
+	"github.com/ipfs/kubo/core/coreiface/options"
+)
+
+// fakeAPI is just enough of an IPFS node for I: added trees are copied
+// into memory under a made-up CID, and names point at CIDs.
+type fakeAPI struct {
+	iface.CoreAPI
+
+	mtx   sync.Mutex
+	trees map[string]hackpadfs.FS
+	names map[string]string
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{trees: map[string]hackpadfs.FS{}, names: map[string]string{}}
+}
+
+// lookup splits an /ipfs/ path into its tree and the path inside it.
+func (a *fakeAPI) lookup(p path.Path) (hackpadfs.FS, string, error) {
+	s := p.Segments()
+	if len(s) < 2 || s[0] != "ipfs" {
+		return nil, "", fmt.Errorf("fake: unsupported path %s", p)
+	}
+	a.mtx.Lock()
+	t, ok := a.trees[s[1]]
+	a.mtx.Unlock()
+	if !ok {
+		return nil, "", fmt.Errorf("fake: no tree %s", s[1])
+	}
+	return t, Dotify(gopath.Join(s[2:]...)), nil
+}
+
+func (a *fakeAPI) ResolveNode(_ context.Context, p path.Path) (ipld.Node, error) {
+	t, y, err := a.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	_, err = hackpadfs.Stat(t, y)
+	if err != nil {
+		return nil, err
+	}
+	return merkledag.NewRawNode([]byte(p.String())), nil
+}
+
+func (a *fakeAPI) Unixfs() iface.UnixfsAPI { return fakeUnixfs{a: a} }
+func (a *fakeAPI) Pin() iface.PinAPI       { return fakePin{} }
+func (a *fakeAPI) Name() iface.NameAPI     { return fakeName{a: a} }
+
+type fakeUnixfs struct {
+	iface.UnixfsAPI
+	a *fakeAPI
+}
+
+func (u fakeUnixfs) Add(_ context.Context, n files.Node, _ ...options.UnixfsAddOption) (path.ImmutablePath, error) {
+	t, err := mem.NewFS()
+	if err != nil {
+		return path.ImmutablePath{}, err
+	}
+	err = files.Walk(n, func(p string, n files.Node) error {
+		p = Dotify(p)
+		switch n := n.(type) {
+		case files.Directory:
+			return hackpadfs.MkdirAll(t, p, 0755)
+		case files.File:
+			b, err := io.ReadAll(n)
+			if err != nil {
+				return err
+			}
+			return hackpadfs.WriteFullFile(t, p, b, 0644)
+		}
+		return fmt.Errorf("fake: unsupported node at %s", p)
+	})
+	if err != nil {
+		return path.ImmutablePath{}, err
+	}
+	u.a.mtx.Lock()
+	defer u.a.mtx.Unlock()
+	c := merkledag.NewRawNode([]byte(fmt.Sprint(len(u.a.trees)))).Cid()
+	u.a.trees[c.String()] = t
+	return path.FromCid(c), nil
+}
+
+func (u fakeUnixfs) Get(_ context.Context, p path.Path) (files.Node, error) {
+	t, y, err := u.a.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return fakeNode(t, y)
+}
+
+func fakeNode(t hackpadfs.FS, y string) (files.Node, error) {
+	s, err := hackpadfs.Stat(t, y)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDir() {
+		b, err := fs.ReadFile(t, y)
+		if err != nil {
+			return nil, err
+		}
+		return files.NewBytesFile(b), nil
+	}
+	es, err := hackpadfs.ReadDir(t, y)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]files.Node{}
+	for _, e := range es {
+		m[e.Name()], err = fakeNode(t, gopath.Join(y, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files.NewMapDirectory(m), nil
+}
+
+type fakePin struct {
+	iface.PinAPI
+}
+
+func (fakePin) Add(context.Context, path.Path, ...options.PinAddOption) error {
+	return nil
+}
+
+type fakeName struct {
+	iface.NameAPI
+	a *fakeAPI
+}
+
+func (n fakeName) Publish(_ context.Context, p path.Path, opts ...options.NamePublishOption) (ipns.Name, error) {
+	o, err := options.NamePublishOptions(opts...)
+	if err != nil {
+		return ipns.Name{}, err
+	}
+	n.a.mtx.Lock()
+	defer n.a.mtx.Unlock()
+	n.a.names[o.Key] = p.Segments()[1]
+	return ipns.Name{}, nil
+}
+
+func (n fakeName) Resolve(_ context.Context, name string, _ ...options.NameResolveOption) (path.Path, error) {
+	n.a.mtx.Lock()
+	c, ok := n.a.names[strings.TrimPrefix(name, "/ipns/")]
+	n.a.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fake: no name %s", name)
+	}
+	return path.NewPath("/ipfs/" + c)
+}
+
+func TestWritableIPNSCommitOpenFile(t *testing.T) {
+	a := newFakeAPI()
+	i := I{CoreAPI: a, Ctx: context.Background()}
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "a", []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := i.Push(m, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.names["k"] = c
+
+	w, err := NewWritableIPNS(NewIPNS(i, "k", 0), "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := hackpadfs.OpenFile(w, "b", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = hackpadfs.WriteFile(f, []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handle outlives the commit: what it writes next must not be
+	// lost from the tree or from the next commit.
+	_, err = hackpadfs.WriteFile(f, []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = w.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.names["k"] != c {
+		t.Errorf("published %s, want %s", a.names["k"], c)
+	}
+
+	for _, x := range []struct {
+		fs   fs.FS
+		name string
+	}{
+		{w, "a"}, {w, "b"}, {i, c + "/a"}, {i, c + "/b"},
+	} {
+		want := map[string]string{"a": "old", "b": "12"}[gopath.Base(x.name)]
+		b, err := fs.ReadFile(x.fs, x.name)
+		if err != nil {
+			t.Errorf("%s: %v", x.name, err)
+		} else if string(b) != want {
+			t.Errorf("%s: got %q, want %q", x.name, b, want)
+		}
+	}
+}
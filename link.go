@@ -0,0 +1,74 @@
+package remount
+
+import (
+	"os"
+
+	"github.com/hack-pad/hackpadfs"
+)
+
+// ReadlinkFS is an FS that can read the target of a symlink. hackpadfs has
+// no equivalent, so backends opt in by implementing it directly.
+type ReadlinkFS interface {
+	hackpadfs.FS
+	Readlink(name string) (string, error)
+}
+
+// LinkFS is an FS that can create hard links.
+type LinkFS interface {
+	hackpadfs.FS
+	Link(oldname, newname string) error
+}
+
+// osPather is implemented by hackpadfs's os backend, which has no
+// Readlink or Link of its own.
+type osPather interface {
+	ToOSPath(name string) (string, error)
+}
+
+// Readlink returns the target of the symlink name, using a ReadlinkFS if
+// fs is one and the host filesystem if fs is backed by it.
+func Readlink(fs hackpadfs.FS, name string) (string, error) {
+	if l, ok := fs.(ReadlinkFS); ok {
+		return l.Readlink(name)
+	}
+	if m, ok := fs.(hackpadfs.MountFS); ok {
+		if mfs, sub := m.Mount(name); mfs != fs {
+			return Readlink(mfs, sub)
+		}
+	}
+	if o, ok := fs.(osPather); ok {
+		p, err := o.ToOSPath(name)
+		if err != nil {
+			return "", err
+		}
+		return os.Readlink(p)
+	}
+	return "", &hackpadfs.PathError{Op: "readlink", Path: name, Err: hackpadfs.ErrNotImplemented}
+}
+
+// Link creates newname as a hard link to oldname, in the same way as
+// Readlink.
+func Link(fs hackpadfs.FS, oldname, newname string) error {
+	if l, ok := fs.(LinkFS); ok {
+		return l.Link(oldname, newname)
+	}
+	if m, ok := fs.(hackpadfs.MountFS); ok {
+		ofs, osub := m.Mount(oldname)
+		nfs, nsub := m.Mount(newname)
+		if ofs == nfs && ofs != fs {
+			return Link(ofs, osub, nsub)
+		}
+	}
+	if o, ok := fs.(osPather); ok {
+		op, err := o.ToOSPath(oldname)
+		if err != nil {
+			return err
+		}
+		np, err := o.ToOSPath(newname)
+		if err != nil {
+			return err
+		}
+		return os.Link(op, np)
+	}
+	return &hackpadfs.LinkError{Op: "link", Old: oldname, New: newname, Err: hackpadfs.ErrNotImplemented}
+}
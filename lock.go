@@ -0,0 +1,169 @@
+package remount
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// ErrLocked is returned when a lock is held by someone else and the
+// caller did not ask to wait for it.
+var ErrLocked error = syscall.EAGAIN
+
+// LockRange is an advisory lock on part of a file. Start and End are both
+// inclusive, and an End of LockEOF runs to the end of the file however
+// long it grows. Whole locks are flock-style locks on the whole file and
+// never conflict with byte-range ones, as on Linux.
+type LockRange struct {
+	Owner      uint64
+	Start, End uint64
+	Write      bool
+	Whole      bool
+}
+
+const LockEOF = math.MaxUint64
+
+func (r LockRange) overlaps(o LockRange) bool {
+	return r.Whole == o.Whole && r.Start <= o.End && o.Start <= r.End
+}
+
+func (r LockRange) conflicts(o LockRange) bool {
+	return r.Owner != o.Owner && r.overlaps(o) && (r.Write || o.Write)
+}
+
+// LockFS is implemented by trees that can lock files natively. Locks
+// takes the backend's lock once it has granted its own, so that other
+// users of the backend are kept out too.
+type LockFS interface {
+	LockFile(name string, r LockRange, wait bool) error
+	UnlockFile(name string, r LockRange) error
+}
+
+// Locks hands out advisory locks on paths. One Locks should be shared by
+// every adapter serving the same tree.
+type Locks struct {
+	// Backend, if set, is locked alongside.
+	Backend LockFS
+
+	mtx     sync.Mutex
+	m       map[string][]LockRange
+	changed chan struct{}
+}
+
+// DefaultLocks is used by adapters that are not given a Locks.
+var DefaultLocks = NewLocks()
+
+func NewLocks() *Locks {
+	return &Locks{m: map[string][]LockRange{}, changed: make(chan struct{})}
+}
+
+var lockOwners uint64
+
+// NewLockOwner returns an owner id not used by anybody else.
+func NewLockOwner() uint64 {
+	return atomic.AddUint64(&lockOwners, 1)
+}
+
+func lockKey(name string) string {
+	return Dotify(path.Clean("/" + name))
+}
+
+// Query returns a lock that would keep r from being taken, if any.
+func (l *Locks) Query(name string, r LockRange) (LockRange, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.query(lockKey(name), r)
+}
+
+// Lock takes r, replacing whatever its owner already held over the same
+// range. If wait is false and someone else holds a conflicting lock, it
+// fails with ErrLocked; otherwise it waits for them until ctx is done.
+func (l *Locks) Lock(ctx context.Context, name string, r LockRange, wait bool) error {
+	k := lockKey(name)
+	for {
+		l.mtx.Lock()
+		_, busy := l.query(k, r)
+		if !busy {
+			l.unlock(k, r)
+			l.m[k] = append(l.m[k], r)
+			l.mtx.Unlock()
+			break
+		}
+		ch := l.changed
+		l.mtx.Unlock()
+		if !wait {
+			return ErrLocked
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if l.Backend != nil {
+		err := l.Backend.LockFile(name, r, wait)
+		if err != nil && !errors.Is(err, syscall.ENOSYS) {
+			l.mtx.Lock()
+			l.unlock(k, r)
+			l.mtx.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Locks) query(k string, r LockRange) (LockRange, bool) {
+	for _, o := range l.m[k] {
+		if r.conflicts(o) {
+			return o, true
+		}
+	}
+	return LockRange{}, false
+}
+
+// Unlock releases whatever r's owner holds over r's range.
+func (l *Locks) Unlock(name string, r LockRange) error {
+	l.mtx.Lock()
+	l.unlock(lockKey(name), r)
+	l.mtx.Unlock()
+	if l.Backend != nil {
+		err := l.Backend.UnlockFile(name, r)
+		if err != nil && !errors.Is(err, syscall.ENOSYS) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlock cuts r out of its owner's locks and wakes any waiters. l.mtx
+// must be held.
+func (l *Locks) unlock(k string, r LockRange) {
+	var n []LockRange
+	for _, o := range l.m[k] {
+		if o.Owner != r.Owner || !o.overlaps(r) {
+			n = append(n, o)
+			continue
+		}
+		if o.Start < r.Start {
+			h := o
+			h.End = r.Start - 1
+			n = append(n, h)
+		}
+		if o.End > r.End {
+			t := o
+			t.Start = r.End + 1
+			n = append(n, t)
+		}
+	}
+	if len(n) == 0 {
+		delete(l.m, k)
+	} else {
+		l.m[k] = n
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -0,0 +1,195 @@
+package remount
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	type step struct {
+		r      LockRange
+		unlock bool
+		err    error
+	}
+	w := func(owner, start, end uint64) LockRange {
+		return LockRange{Owner: owner, Start: start, End: end, Write: true}
+	}
+	r := func(owner, start, end uint64) LockRange {
+		return LockRange{Owner: owner, Start: start, End: end}
+	}
+	whole := func(owner uint64, write bool) LockRange {
+		return LockRange{Owner: owner, End: LockEOF, Write: write, Whole: true}
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  []LockRange
+	}{
+		{
+			name:  "unlock middle splits",
+			steps: []step{{r: w(1, 0, 99)}, {r: w(1, 10, 19), unlock: true}},
+			want:  []LockRange{w(1, 0, 9), w(1, 20, 99)},
+		},
+		{
+			name:  "unlock head",
+			steps: []step{{r: w(1, 0, 99)}, {r: w(1, 0, 49), unlock: true}},
+			want:  []LockRange{w(1, 50, 99)},
+		},
+		{
+			name:  "unlock to EOF",
+			steps: []step{{r: w(1, 0, LockEOF)}, {r: w(1, 50, LockEOF), unlock: true}},
+			want:  []LockRange{w(1, 0, 49)},
+		},
+		{
+			name:  "unlock all",
+			steps: []step{{r: w(1, 10, 20)}, {r: w(1, 0, LockEOF), unlock: true}},
+		},
+		{
+			name:  "unlock by another owner",
+			steps: []step{{r: w(1, 0, 9)}, {r: w(2, 0, LockEOF), unlock: true}},
+			want:  []LockRange{w(1, 0, 9)},
+		},
+		{
+			name:  "readers share",
+			steps: []step{{r: r(1, 0, 9)}, {r: r(2, 5, 14)}},
+			want:  []LockRange{r(1, 0, 9), r(2, 5, 14)},
+		},
+		{
+			name:  "writer waits for reader",
+			steps: []step{{r: r(1, 0, 9)}, {r: w(2, 9, 9), err: ErrLocked}},
+			want:  []LockRange{r(1, 0, 9)},
+		},
+		{
+			name:  "reader waits for writer",
+			steps: []step{{r: w(1, 0, 9)}, {r: r(2, 0, 0), err: ErrLocked}},
+			want:  []LockRange{w(1, 0, 9)},
+		},
+		{
+			name:  "disjoint writers",
+			steps: []step{{r: w(1, 0, 9)}, {r: w(2, 10, 19)}},
+			want:  []LockRange{w(1, 0, 9), w(2, 10, 19)},
+		},
+		{
+			name:  "owner never conflicts with itself",
+			steps: []step{{r: w(1, 0, 9)}, {r: w(1, 5, 14)}},
+			want:  []LockRange{w(1, 0, 4), w(1, 5, 14)},
+		},
+		{
+			name: "owner replaces its own range",
+			steps: []step{
+				{r: w(1, 0, 99)},
+				{r: r(1, 10, 19)},
+				{r: r(2, 10, 19)},
+				{r: r(2, 20, 20), err: ErrLocked},
+			},
+			want: []LockRange{w(1, 0, 9), r(1, 10, 19), r(2, 10, 19), w(1, 20, 99)},
+		},
+		{
+			name:  "EOF lock covers growth",
+			steps: []step{{r: w(1, 100, LockEOF)}, {r: w(2, 1<<40, 1<<40), err: ErrLocked}, {r: w(2, 0, 99)}},
+			want:  []LockRange{w(2, 0, 99), w(1, 100, LockEOF)},
+		},
+		{
+			name:  "whole and range locks are apart",
+			steps: []step{{r: whole(1, true)}, {r: w(2, 0, 9)}},
+			want:  []LockRange{w(2, 0, 9), whole(1, true)},
+		},
+		{
+			name:  "whole locks conflict",
+			steps: []step{{r: whole(1, false)}, {r: whole(2, false)}, {r: whole(3, true), err: ErrLocked}},
+			want:  []LockRange{whole(1, false), whole(2, false)},
+		},
+		{
+			name:  "whole lock upgrade",
+			steps: []step{{r: whole(1, false)}, {r: whole(1, true)}},
+			want:  []LockRange{whole(1, true)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLocks()
+			for i, s := range tt.steps {
+				var err error
+				if s.unlock {
+					err = l.Unlock("f", s.r)
+				} else {
+					err = l.Lock(context.Background(), "f", s.r, false)
+				}
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d: got %v, want %v", i, err, s.err)
+				}
+			}
+			got := append([]LockRange(nil), l.m["f"]...)
+			sort.Slice(got, func(a, b int) bool {
+				x, y := got[a], got[b]
+				if x.Whole != y.Whole {
+					return !x.Whole
+				}
+				if x.Start != y.Start {
+					return x.Start < y.Start
+				}
+				return x.Owner < y.Owner
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocksQuery(t *testing.T) {
+	l := NewLocks()
+	held := LockRange{Owner: 1, Start: 10, End: 19, Write: true}
+	err := l.Lock(context.Background(), "/d/../f", held, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, busy := l.Query("f", LockRange{Owner: 2, Start: 0, End: LockEOF})
+	if !busy || o != held {
+		t.Errorf("Query: got %+v, %v, want %+v", o, busy, held)
+	}
+	_, busy = l.Query("f", LockRange{Owner: 1, Start: 0, End: LockEOF, Write: true})
+	if busy {
+		t.Error("Query: owner conflicts with itself")
+	}
+}
+
+func TestLocksWait(t *testing.T) {
+	l := NewLocks()
+	a := LockRange{Owner: 1, End: LockEOF, Write: true}
+	b := LockRange{Owner: 2, End: LockEOF, Write: true}
+	err := l.Lock(context.Background(), "f", a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = l.Lock(ctx, "f", b, true)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Lock with deadline: got %v, want DeadlineExceeded", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Lock(context.Background(), "f", b, true)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = l.Unlock("f", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not woken by Unlock")
+	}
+}
@@ -0,0 +1,239 @@
+package remount
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/DeedleFake/p9"
+)
+
+func aname(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// MultiDir is a FileSystem that serves several Dirs from one listener,
+// each under its own aname. Trees can be registered and unregistered
+// while the server runs; unregistering a tree only stops new attaches,
+// clients that are already attached keep their view of it.
+//
+// Authentication is delegated to the Dir being attached to.
+type MultiDir struct {
+	mtx sync.RWMutex
+	m   map[string]Dir
+}
+
+func NewMultiDir() *MultiDir {
+	return &MultiDir{m: map[string]Dir{}}
+}
+
+// Register serves d under name, replacing any tree already there.
+func (m *MultiDir) Register(name string, d Dir) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.m[aname(name)] = d
+}
+
+// Unregister stops serving the tree under name.
+func (m *MultiDir) Unregister(name string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.m, aname(name))
+}
+
+// Names returns the anames currently being served.
+func (m *MultiDir) Names() []string {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	n := make([]string, 0, len(m.m))
+	for k := range m.m {
+		n = append(n, k)
+	}
+	return n
+}
+
+func (m *MultiDir) lookup(name string) (Dir, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	d, ok := m.m[aname(name)]
+	if !ok {
+		return Dir{}, errors.New("unknown attachment")
+	}
+	return d, nil
+}
+
+// Auth implements FileSystem.Auth.
+func (m *MultiDir) Auth(user, aname string) (p9.File, error) {
+	d, err := m.lookup(aname)
+	if err != nil {
+		return nil, err
+	}
+	return d.Auth(user, aname)
+}
+
+// Attach implements FileSystem.Attach.
+func (m *MultiDir) Attach(afile p9.File, user, name string) (p9.Attachment, error) {
+	d, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	err = d.authorize(afile, user, name)
+	if err != nil {
+		return nil, err
+	}
+	d.user = user
+	return subDir{Dir: d, prefix: aname(name)}, nil
+}
+
+var _ p9.FileSystem = &MultiDir{}
+
+// subDir is a Dir attached under a non-root aname. The 9P server hands
+// it paths that still begin with the aname, which it strips before
+// passing them on.
+type subDir struct {
+	Dir
+	prefix string
+}
+
+// rel strips the aname from p. Paths outside the aname are refused, as
+// they would otherwise be served from the wrong place in the tree.
+func (s subDir) rel(p string) (string, error) {
+	p = aname(p)
+	if s.prefix == "" {
+		return p, nil
+	}
+	if p != s.prefix && !strings.HasPrefix(p, s.prefix+"/") {
+		return "", &fs.PathError{Op: "walk", Path: p, Err: fs.ErrNotExist}
+	}
+	return p[len(s.prefix):], nil
+}
+
+// rel2 is rel for operations on two paths.
+func (s subDir) rel2(oldp, newp string) (string, string, error) {
+	o, err := s.rel(oldp)
+	if err != nil {
+		return "", "", err
+	}
+	n, err := s.rel(newp)
+	if err != nil {
+		return "", "", err
+	}
+	return o, n, nil
+}
+
+func (s subDir) Stat(p string) (p9.DirEntry, error) {
+	r, err := s.rel(p)
+	if err != nil {
+		return p9.DirEntry{}, err
+	}
+	return s.Dir.Stat(r)
+}
+
+func (s subDir) WriteStat(p string, changes p9.StatChanges) error {
+	r, err := s.rel(p)
+	if err != nil {
+		return err
+	}
+	return s.Dir.WriteStat(r, changes)
+}
+
+func (s subDir) Open(p string, mode uint8) (p9.File, error) {
+	r, err := s.rel(p)
+	if err != nil {
+		return nil, err
+	}
+	return s.Dir.Open(r, mode)
+}
+
+func (s subDir) Create(p string, perm p9.FileMode, mode uint8) (p9.File, error) {
+	r, err := s.rel(p)
+	if err != nil {
+		return nil, err
+	}
+	return s.Dir.Create(r, perm, mode)
+}
+
+func (s subDir) Remove(p string) error {
+	r, err := s.rel(p)
+	if err != nil {
+		return err
+	}
+	return s.Dir.Remove(r)
+}
+
+func (s subDir) GetQID(p string) (p9.QID, error) {
+	r, err := s.rel(p)
+	if err != nil {
+		return p9.QID{}, err
+	}
+	return s.Dir.GetQID(r)
+}
+
+func (s subDir) Readlink(p string) (string, error) {
+	r, err := s.rel(p)
+	if err != nil {
+		return "", err
+	}
+	return s.Dir.Readlink(r)
+}
+
+func (s subDir) Link(oldp, newp string) error {
+	o, n, err := s.rel2(oldp, newp)
+	if err != nil {
+		return err
+	}
+	return s.Dir.Link(o, n)
+}
+
+func (s subDir) Mknod(p string, mode fs.FileMode, dev int) error {
+	r, err := s.rel(p)
+	if err != nil {
+		return err
+	}
+	return s.Dir.Mknod(r, mode, dev)
+}
+
+func (s subDir) Rename(oldp, newp string) error {
+	o, n, err := s.rel2(oldp, newp)
+	if err != nil {
+		return err
+	}
+	return s.Dir.Rename(o, n)
+}
+
+func (s subDir) GetXattr(p, attr string) ([]byte, error) {
+	r, err := s.rel(p)
+	if err != nil {
+		return nil, err
+	}
+	return s.Dir.GetXattr(r, attr)
+}
+
+func (s subDir) SetXattr(p, attr string, value []byte, flags int) error {
+	r, err := s.rel(p)
+	if err != nil {
+		return err
+	}
+	return s.Dir.SetXattr(r, attr, value, flags)
+}
+
+func (s subDir) ListXattr(p string) ([]string, error) {
+	r, err := s.rel(p)
+	if err != nil {
+		return nil, err
+	}
+	return s.Dir.ListXattr(r)
+}
+
+func (s subDir) RemoveXattr(p, attr string) error {
+	r, err := s.rel(p)
+	if err != nil {
+		return err
+	}
+	return s.Dir.RemoveXattr(r, attr)
+}
+
+var _ p9.Attachment = subDir{}
+var _ p9.QIDFS = subDir{}
@@ -0,0 +1,222 @@
+package remount
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/DeedleFake/p9"
+	"github.com/hack-pad/hackpadfs"
+)
+
+// Perms tells Dir who owns a file so that it can check the mode bits
+// against the attached 9P user.
+type Perms interface {
+	// Owner returns the owning user and group of the file at p. If ok
+	// is false, everybody is treated as "other".
+	Owner(p string, fi hackpadfs.FileInfo) (owner, group string, ok bool)
+	InGroup(user, group string) bool
+}
+
+const (
+	permRead  = 04
+	permWrite = 02
+	permExec  = 01
+)
+
+// SysPerms takes ownership from the *syscall.Stat_t in FileInfo.Sys,
+// as filled in by the os backend, and resolves ids to names on the host.
+type SysPerms struct{}
+
+func (SysPerms) Owner(p string, fi hackpadfs.FileInfo) (string, string, bool) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", "", false
+	}
+	owner := strconv.FormatUint(uint64(s.Uid), 10)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group := strconv.FormatUint(uint64(s.Gid), 10)
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner, group, true
+}
+
+func (SysPerms) InGroup(name, group string) bool {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return false
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, id := range ids {
+		if id == group {
+			return true
+		}
+		if g, err := user.LookupGroupId(id); err == nil && g.Name == group {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL assigns owners to subtrees and members to groups, for trees whose
+// backend has no notion of ownership. A path inherits the owner of its
+// nearest listed ancestor.
+type ACL struct {
+	Owners map[string][2]string
+	Groups map[string][]string
+}
+
+// LoadACL parses a sidecar ACL file made of lines of the form
+//
+//	owner <path> <user> <group>
+//	group <name> <member>...
+//
+// Blank lines and lines starting with # are ignored.
+func LoadACL(r io.Reader) (*ACL, error) {
+	a := &ACL{Owners: map[string][2]string{}, Groups: map[string][]string{}}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		switch {
+		case f[0] == "owner" && len(f) == 4:
+			a.Owners[Dotify(path.Clean("/"+f[1]))] = [2]string{f[2], f[3]}
+		case f[0] == "group" && len(f) >= 2:
+			a.Groups[f[1]] = append(a.Groups[f[1]], f[2:]...)
+		default:
+			return nil, errors.New("malformed acl line: " + s.Text())
+		}
+	}
+	return a, s.Err()
+}
+
+// ReadACL loads a sidecar ACL file stored inside fs itself.
+func ReadACL(fs hackpadfs.FS, name string) (*ACL, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadACL(f)
+}
+
+func (a *ACL) Owner(p string, fi hackpadfs.FileInfo) (string, string, bool) {
+	p = Dotify(path.Clean("/" + p))
+	for {
+		if o, ok := a.Owners[p]; ok {
+			return o[0], o[1], true
+		}
+		if p == "." {
+			return "", "", false
+		}
+		p = path.Dir(p)
+	}
+}
+
+func (a *ACL) InGroup(name, group string) bool {
+	for _, m := range a.Groups[group] {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// access checks that the attached user can search every directory
+// above p and has all of the want bits on the file at p.
+func (d Dir) access(p string, want fs.FileMode) error {
+	if d.Perms == nil {
+		return nil
+	}
+	err := d.search(p)
+	if err != nil {
+		return err
+	}
+	return d.allowed(p, want)
+}
+
+// search checks for exec permission on every directory above p, up to
+// the attachment root.
+func (d Dir) search(p string) error {
+	q := path.Clean("/" + p)
+	for q != "/" {
+		q = path.Dir(q)
+		err := d.allowed(q, permExec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d Dir) allowed(p string, want fs.FileMode) error {
+	fi, err := hackpadfs.Stat(d.FS, Dotify(p))
+	if err != nil {
+		return err
+	}
+	m := fi.Mode().Perm()
+	owner, group, ok := d.Perms.Owner(p, fi)
+	switch {
+	case ok && owner == d.user:
+		m >>= 6
+	case ok && d.Perms.InGroup(d.user, group):
+		m >>= 3
+	}
+	if m&want != want {
+		return &fs.PathError{Op: "access", Path: p, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// owns checks that the attached user can reach and owns the file at p,
+// as needed to change its metadata.
+func (d Dir) owns(p string) error {
+	if d.Perms == nil {
+		return nil
+	}
+	err := d.search(p)
+	if err != nil {
+		return err
+	}
+	fi, err := hackpadfs.Stat(d.FS, Dotify(p))
+	if err != nil {
+		return err
+	}
+	owner, _, ok := d.Perms.Owner(p, fi)
+	if !ok || owner != d.user {
+		return &fs.PathError{Op: "wstat", Path: p, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func openPerm(mode uint8) fs.FileMode {
+	var want fs.FileMode
+	switch mode & 3 {
+	case p9.OREAD:
+		want = permRead
+	case p9.OWRITE:
+		want = permWrite
+	case p9.ORDWR:
+		want = permRead | permWrite
+	case p9.OEXEC:
+		want = permExec
+	}
+	if mode&p9.OTRUNC != 0 {
+		want |= permWrite
+	}
+	return want
+}
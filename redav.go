@@ -2,12 +2,19 @@ package remount
 
 import (
 	"errors"
+	"io"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"os/user"
+	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/DeedleFake/p9"
 	"github.com/hack-pad/hackpadfs"
+	"github.com/tetratelabs/wazero/sys"
 )
 
 func Dotify(p string) string {
@@ -22,11 +29,24 @@ func Dotify(p string) string {
 // filesystem. It accepts attachments of either "" or "/", but rejects
 // all others.
 //
-// Note that Dir does not support authentication, simply returning an
-// error for any attempt to do so. If authentication is necessary,
-// wrap a Dir in an AuthFS instance.
+// If Authenticator is set, clients must authenticate through an afid
+// before attaching; otherwise any attempt to authenticate fails and
+// every user may attach.
+//
+// If Perms is set, the attached user's rights are checked against the
+// file mode bits before opening, creating, removing or changing files.
+//
+// Extended attributes are kept by the FS itself if it is an XattrFS, or
+// else by Xattrs.
 type Dir struct {
 	hackpadfs.FS
+	// Inodes numbers the entries served. If nil, paths are hashed.
+	Inodes        Inodes
+	Authenticator Authenticator
+	Perms         Perms
+	Xattrs        XattrFS
+
+	user string
 }
 
 func (d Dir) path(p string) hackpadfs.FS {
@@ -34,131 +54,327 @@ func (d Dir) path(p string) hackpadfs.FS {
 	return s
 }
 
-func infoToEntry(fi hackpadfs.FileInfo) p9.DirEntry {
+func (d Dir) infoToEntry(p string, fi hackpadfs.FileInfo) p9.DirEntry {
 	return p9.DirEntry{
 		FileMode:  p9.ModeFromOS(fi.Mode()),
 		MTime:     fi.ModTime(),
 		Length:    uint64(fi.Size()),
 		EntryName: fi.Name(),
+		Path:      inodes(d.Inodes).Ino(p),
+		Version:   qidVersion(fi),
+	}
+}
+
+// qidVersion derives a qid version from the modification time and size,
+// so clients see it change whenever the file is written.
+func qidVersion(fi hackpadfs.FileInfo) uint32 {
+	if fi.ModTime().IsZero() {
+		return 0
 	}
+	t := uint64(fi.ModTime().UnixNano())
+	return uint32(t) ^ uint32(t>>32) ^ uint32(fi.Size())
 }
 
-func infoToEntryD(fi hackpadfs.DirEntry) p9.DirEntry {
-	i, _ := fi.Info()
-	return infoToEntry(i)
+// GetQID implements QIDFS.GetQID.
+func (d Dir) GetQID(p string) (p9.QID, error) {
+	fi, err := hackpadfs.LstatOrStat(d.FS, Dotify(p))
+	if err != nil {
+		return p9.QID{}, err
+	}
+	e := d.infoToEntry(p, fi)
+	return p9.QID{
+		Type:    e.FileMode.QIDType(),
+		Version: e.Version,
+		Path:    e.Path,
+	}, nil
 }
 
-// Stat implements Attachment.Stat.
+var _ p9.QIDFS = Dir{}
+
+// Stat implements Attachment.Stat. Symlinks are reported as themselves
+// rather than followed.
 func (d Dir) Stat(p string) (p9.DirEntry, error) {
-	fi, err := hackpadfs.Stat(d.FS, Dotify(p))
+	fi, err := hackpadfs.LstatOrStat(d.FS, Dotify(p))
 	if err != nil {
 		return p9.DirEntry{}, err
 	}
-	return infoToEntry(fi), nil
+	return d.infoToEntry(p, fi), nil
 }
 
 // WriteStat implements Attachment.WriteStat.
-func (d Dir) WriteStat(p string, changes p9.StatChanges) error {
-	// TODO: Add support for other values.
+//
+// Changes are applied in order of how easily they can be undone, with
+// truncation last. If any change fails, the ones already applied are
+// rolled back before the error is returned.
+func (d Dir) WriteStat(p string, changes p9.StatChanges) (err error) {
+	p = Dotify(p)
+	base := path.Dir(p)
+
+	_, okm := changes.Mode()
+	_, oka := changes.ATime()
+	_, okt := changes.MTime()
+	_, oku := changes.UID()
+	_, okg := changes.GID()
+	if okm || oka || okt || oku || okg {
+		err := d.owns(p)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := changes.Length(); ok {
+		err := d.access(p, permWrite)
+		if err != nil {
+			return err
+		}
+	}
+	name, okn := changes.Name()
+	var np string
+	if okn {
+		// Plain names stay in the same directory, as 9P intends;
+		// slashed names move the file, relative to the attachment root
+		// if absolute.
+		np = path.Join(base, name)
+		if strings.HasPrefix(name, "/") {
+			np = name
+		}
+		np = Dotify(path.Clean("/" + np))
+		err := d.access(base, permWrite|permExec)
+		if err != nil {
+			return err
+		}
+		err = d.access(path.Dir(np), permWrite|permExec)
+		if err != nil {
+			return err
+		}
+		// 9P renames never replace an existing file.
+		if np != p {
+			_, err = hackpadfs.LstatOrStat(d.FS, np)
+			if err == nil {
+				return &fs.PathError{Op: "wstat", Path: np, Err: fs.ErrExist}
+			}
+		}
+	}
+
+	// Changes other than renames follow symlinks, so they are undone
+	// from the target's info, but a dangling link can still be renamed.
+	fi, err := hackpadfs.Stat(d.FS, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		fi, err = hackpadfs.LstatOrStat(d.FS, p)
+	}
+	if err != nil {
+		return err
+	}
 
-	// p = d.path(p)
-	base := filepath.Dir(Dotify(p))
+	cur := p
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}()
 
 	mode, ok := changes.Mode()
 	if ok {
-		err := hackpadfs.Chmod(d.FS, p, mode.OS())
+		err = hackpadfs.Chmod(d.FS, p, mode.OS())
 		if err != nil {
 			return err
 		}
+		undo = append(undo, func() error {
+			return hackpadfs.Chmod(d.FS, p, fi.Mode())
+		})
+	}
+
+	uid, oku := changes.UID()
+	gid, okg := changes.GID()
+	if oku || okg {
+		ouid, ogid := fileOwner(fi)
+		u, g := ouid, ogid
+		if oku {
+			u, err = lookupUID(uid)
+			if err != nil {
+				return err
+			}
+		}
+		if okg {
+			g, err = lookupGID(gid)
+			if err != nil {
+				return err
+			}
+		}
+		err = hackpadfs.Chown(d.FS, p, u, g)
+		if err != nil {
+			return err
+		}
+		undo = append(undo, func() error {
+			return hackpadfs.Chown(d.FS, p, ouid, ogid)
+		})
 	}
 
 	atime, ok1 := changes.ATime()
 	mtime, ok2 := changes.MTime()
 	if ok1 || ok2 {
-		err := hackpadfs.Chtimes(d.FS, p, atime, mtime)
+		oatime := time.Unix(0, sys.NewStat_t(fi).Atim)
+		if !ok1 {
+			atime = oatime
+		}
+		if !ok2 {
+			mtime = fi.ModTime()
+		}
+		err = hackpadfs.Chtimes(d.FS, p, atime, mtime)
+		if err != nil {
+			return err
+		}
+		undo = append(undo, func() error {
+			return hackpadfs.Chtimes(d.FS, p, oatime, fi.ModTime())
+		})
+	}
+
+	if okn && np != p {
+		err = hackpadfs.Rename(d.FS, p, np)
 		if err != nil {
 			return err
 		}
+		// Undo in reverse order, so the rename is reverted before any
+		// of the earlier changes are, and they can keep using p.
+		undo = append(undo, func() error {
+			return hackpadfs.Rename(d.FS, np, p)
+		})
+		cur = np
 	}
 
 	length, ok := changes.Length()
 	if ok {
-		o, err := d.FS.Open(p)
+		var o hackpadfs.File
+		o, err = hackpadfs.OpenFile(d.FS, cur, os.O_WRONLY, 0)
 		if err != nil {
 			return err
 		}
 		err = hackpadfs.TruncateFile(o, int64(length))
-		if err != nil {
-			return err
+		cerr := o.Close()
+		if err == nil {
+			err = cerr
 		}
-	}
-
-	name, ok := changes.Name()
-	if ok {
-		err := hackpadfs.Rename(d.FS, p, filepath.Join(base, filepath.FromSlash(name)))
 		if err != nil {
 			return err
 		}
 	}
 
+	if okn && np != p {
+		return d.movedXattrs(p, np)
+	}
 	return nil
 }
 
-func toOSFlags(mode uint8) (flag int) {
-	if mode&p9.OREAD != 0 {
-		flag |= os.O_RDONLY
+// fileOwner returns the numeric owner of fi, or -1 for ids the backend
+// does not report, which Chown leaves untouched.
+func fileOwner(fi hackpadfs.FileInfo) (int, int) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+	return int(s.Uid), int(s.Gid)
+}
+
+func lookupUID(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		return n, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGID(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		return n, nil
 	}
-	if mode&p9.OWRITE != 0 {
-		flag |= os.O_WRONLY
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
 	}
-	if mode&p9.ORDWR != 0 {
-		flag |= os.O_RDWR
+	return strconv.Atoi(g.Gid)
+}
+
+// toOSFlags converts 9P open modes to os.OpenFile flags. OEXEC opens
+// for reading; ORCLOSE has no flag equivalent and is handled by Dir.
+//
+// 9P open modes are a single byte, so OEXCL and OAPPEND cannot reach an
+// Attachment. Instead, Create is always exclusive, as Tcreate is, and
+// files with ModeAppend set are opened for appending.
+func toOSFlags(mode uint8) (flag int) {
+	switch mode & 3 {
+	case p9.OREAD, p9.OEXEC:
+		flag = os.O_RDONLY
+	case p9.OWRITE:
+		flag = os.O_WRONLY
+	case p9.ORDWR:
+		flag = os.O_RDWR
 	}
 	if mode&p9.OTRUNC != 0 {
 		flag |= os.O_TRUNC
 	}
-	//if mode&OEXCL != 0 {
-	//	flag |= os.O_EXCL
-	//}
-	//if mode&OAPPEND != 0 {
-	//	flag |= os.O_APPEND
-	//}
+	if mode&p9.OCEXEC != 0 {
+		flag |= syscall.O_CLOEXEC
+	}
 
 	return flag
 }
 
+// fromOSFlags converts os.OpenFile flags to 9P open modes. O_CREATE,
+// O_EXCL and O_APPEND have no open mode; FSW implements them itself.
 func fromOSFlags(mode int) (flag uint8) {
-	if mode&os.O_RDONLY != 0 {
-		flag |= p9.OREAD
-	}
-	if mode&os.O_WRONLY != 0 {
-		flag |= p9.OWRITE
-	}
-	if mode&os.O_RDWR != 0 {
-		flag |= p9.ORDWR
+	switch mode & syscall.O_ACCMODE {
+	case os.O_RDONLY:
+		flag = p9.OREAD
+	case os.O_WRONLY:
+		flag = p9.OWRITE
+	case os.O_RDWR:
+		flag = p9.ORDWR
 	}
 	if mode&os.O_TRUNC != 0 {
 		flag |= p9.OTRUNC
 	}
-	//if mode&OEXCL != 0 {
-	//	flag |= os.O_EXCL
-	//}
-	//if mode&OAPPEND != 0 {
-	//	flag |= os.O_APPEND
-	//}
+	if mode&syscall.O_CLOEXEC != 0 {
+		flag |= p9.OCEXEC
+	}
 
 	return flag
 }
 
 // Auth implements FileSystem.Auth.
 func (d Dir) Auth(user, aname string) (p9.File, error) {
-	return nil, errors.New("auth not supported")
+	if d.Authenticator == nil {
+		return nil, errors.New("auth not supported")
+	}
+	return newAuthFile(user, aname)
+}
+
+func (d Dir) authorize(afile p9.File, user, aname string) error {
+	if d.Authenticator == nil {
+		return nil
+	}
+	a, ok := afile.(*authFile)
+	if !ok {
+		return errors.New("authentication required")
+	}
+	return a.check(d.Authenticator, user, aname)
 }
 
 // Attach implements FileSystem.Attach.
 func (d Dir) Attach(afile p9.File, user, aname string) (p9.Attachment, error) {
+	err := d.authorize(afile, user, aname)
+	if err != nil {
+		return nil, err
+	}
+
 	switch aname {
 	case "", "/":
+		d.user = user
 		return d, nil
 	}
 
@@ -167,40 +383,258 @@ func (d Dir) Attach(afile p9.File, user, aname string) (p9.Attachment, error) {
 
 // Open implements Attachment.Open.
 func (d Dir) Open(p string, mode uint8) (p9.File, error) {
+	err := d.access(p, openPerm(mode))
+	if err != nil {
+		return nil, err
+	}
+	if mode&p9.ORCLOSE != 0 {
+		err := d.access(path.Dir(p), permWrite|permExec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	flag := toOSFlags(mode)
+	fi, err := hackpadfs.Stat(d.FS, Dotify(p))
+	if err == nil && fi.Mode()&os.ModeAppend != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		flag |= os.O_APPEND
+	}
 
 	file, err := hackpadfs.OpenFile(d.FS, Dotify(p), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return d.file(file, p, flag, mode), nil
+}
+
+func (d Dir) file(file hackpadfs.File, p string, flag int, mode uint8) *dirFile {
 	return &dirFile{
-		File: file,
-	}, err
+		File:   file,
+		d:      d,
+		p:      p,
+		append: flag&os.O_APPEND != 0,
+		rclose: mode&p9.ORCLOSE != 0,
+	}
+}
+
+// MknodFS is an FS that can create device files, FIFOs and sockets.
+type MknodFS interface {
+	hackpadfs.FS
+	Mknod(name string, mode hackpadfs.FileMode, dev int) error
+}
+
+// Mknod implements Mknoder.Mknod.
+func (d Dir) Mknod(p string, mode fs.FileMode, dev int) error {
+	err := d.access(path.Dir(p), permWrite|permExec)
+	if err != nil {
+		return err
+	}
+	if mode&fs.ModeType == 0 {
+		f, err := hackpadfs.OpenFile(d.FS, Dotify(p), os.O_CREATE|os.O_EXCL|os.O_RDONLY, mode.Perm())
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	m, ok := d.FS.(MknodFS)
+	if !ok {
+		return &fs.PathError{Op: "mknod", Path: p, Err: hackpadfs.ErrNotImplemented}
+	}
+	return m.Mknod(Dotify(p), mode, dev)
 }
 
+// pendingLink is the target of a symlink created over 9P until its real
+// target has been written.
+const pendingLink = ".remount-pending-symlink"
+
 // Create implements Attachment.Create.
+//
+// Directories are created and then opened for reading. Symlinks are
+// created pointing nowhere and get whatever was written to the returned
+// file as their target once it is closed. Devices, FIFOs and sockets
+// need an MknodFS; 9P has no way to give a device number, so they get
+// device 0.
 func (d Dir) Create(p string, perm p9.FileMode, mode uint8) (p9.File, error) {
-	// p = d.path(p)
+	err := d.access(path.Dir(p), permWrite|permExec)
+	if err != nil {
+		return nil, err
+	}
 
-	if perm&p9.ModeDir != 0 {
-		err := os.Mkdir(p, os.FileMode(perm.Perm().OS()))
+	n := Dotify(p)
+	flag := toOSFlags(mode)
+	made := false
+	switch {
+	case perm&p9.ModeDir != 0:
+		err := hackpadfs.Mkdir(d.FS, n, perm.Perm().OS())
 		if err != nil {
 			return nil, err
 		}
+		flag = os.O_RDONLY
+		made = true
+
+	case perm&p9.ModeSymlink != 0:
+		// The server looks the new file up as soon as it is created,
+		// so the link has to exist before its target is known.
+		err := hackpadfs.Symlink(d.FS, pendingLink, n)
+		if err != nil {
+			return nil, err
+		}
+		return &symlinkFile{d: d, p: n}, nil
+
+	case perm&(p9.ModeDevice|p9.ModeNamedPipe|p9.ModeSocket) != 0:
+		err := d.Mknod(p, perm.OS(), 0)
+		if err != nil {
+			return nil, err
+		}
+		return specialFile{}, nil
+
+	default:
+		// Not every backend honours O_EXCL.
+		if _, err := hackpadfs.LstatOrStat(d.FS, n); err == nil {
+			return nil, &fs.PathError{Op: "create", Path: p, Err: fs.ErrExist}
+		}
+		flag |= os.O_CREATE | os.O_EXCL
+		if perm&p9.ModeAppend != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			flag |= os.O_APPEND
+		}
 	}
 
-	flag := toOSFlags(mode)
+	file, err := hackpadfs.OpenFile(d.FS, n, flag, perm.Perm().OS())
+	if err != nil {
+		// Do not leave behind a directory the client was told
+		// could not be created.
+		if made {
+			hackpadfs.Remove(d.FS, n)
+		}
+		return nil, err
+	}
+	return d.file(file, p, flag, mode), nil
+}
 
-	file, err := hackpadfs.OpenFile(d.FS, Dotify(p), flag|os.O_CREATE, os.FileMode(perm.Perm().OS()))
-	return &dirFile{
-		File: file,
-	}, err
+// specialFile is what creating a device, FIFO or socket returns. Opening
+// the node itself could block on a FIFO or fail on a socket, so the
+// handle does no I/O; clients open the node again to use it.
+type specialFile struct{}
+
+func (specialFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EINVAL
+}
+
+func (specialFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EINVAL
+}
+
+func (specialFile) Readdir() ([]p9.DirEntry, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (specialFile) Close() error {
+	return nil
+}
+
+// maxLinkTarget is PATH_MAX, the longest target a symlink may have.
+const maxLinkTarget = 4096
+
+// symlinkFile collects the target of a symlink being created over 9P,
+// where the client creates the link and then writes its target.
+type symlinkFile struct {
+	d      Dir
+	p      string
+	target []byte
+}
+
+func (f *symlinkFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *symlinkFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off > maxLinkTarget || int64(len(p)) > maxLinkTarget-off {
+		return 0, syscall.ENAMETOOLONG
+	}
+	if end := int(off) + len(p); end > len(f.target) {
+		f.target = append(f.target, make([]byte, end-len(f.target))...)
+	}
+	copy(f.target[off:], p)
+	return len(p), nil
+}
+
+func (f *symlinkFile) Readdir() ([]p9.DirEntry, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *symlinkFile) Close() error {
+	err := hackpadfs.Remove(f.d.FS, f.p)
+	if err != nil {
+		return err
+	}
+	if len(f.target) == 0 {
+		return &fs.PathError{Op: "symlink", Path: f.p, Err: hackpadfs.ErrInvalid}
+	}
+	return hackpadfs.Symlink(f.d.FS, string(f.target), f.p)
+}
+
+// Readlink implements Readlinker.Readlink.
+func (d Dir) Readlink(p string) (string, error) {
+	err := d.access(path.Dir(p), permExec)
+	if err != nil {
+		return "", err
+	}
+	return Readlink(d.FS, Dotify(p))
+}
+
+// Link implements Linker.Link.
+func (d Dir) Link(oldp, newp string) error {
+	err := d.access(path.Dir(newp), permWrite|permExec)
+	if err != nil {
+		return err
+	}
+	return Link(d.FS, Dotify(oldp), Dotify(newp))
+}
+
+// Rename implements Renamer.Rename. Unlike a rename through WriteStat,
+// it replaces newp if it exists.
+func (d Dir) Rename(oldp, newp string) error {
+	err := d.access(path.Dir(oldp), permWrite|permExec)
+	if err != nil {
+		return err
+	}
+	err = d.access(path.Dir(newp), permWrite|permExec)
+	if err != nil {
+		return err
+	}
+	err = hackpadfs.Rename(d.FS, Dotify(oldp), Dotify(newp))
+	if err != nil {
+		return err
+	}
+	return d.movedXattrs(oldp, newp)
 }
 
 // Remove implements Attachment.Remove.
 func (d Dir) Remove(p string) error {
-	return hackpadfs.Remove(d.FS, Dotify(p))
+	err := d.access(path.Dir(p), permWrite|permExec)
+	if err != nil {
+		return err
+	}
+	err = hackpadfs.Remove(d.FS, Dotify(p))
+	if err != nil {
+		return err
+	}
+	return d.droppedXattrs(p)
 }
 
 type dirFile struct {
 	hackpadfs.File
+	d Dir
+	p string
+
+	// append makes writes ignore their offset, since files opened
+	// with O_APPEND refuse WriteAt.
+	append bool
+	// rclose removes the file once it is closed.
+	rclose bool
 }
 
 func (f *dirFile) ReadAt(p []byte, off int64) (n int, err error) {
@@ -208,12 +642,37 @@ func (f *dirFile) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *dirFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.append {
+		return hackpadfs.WriteFile(f.File, p)
+	}
 	return hackpadfs.WriteAtFile(f.File, p, off)
 }
 
+func (f *dirFile) Close() error {
+	err := f.File.Close()
+	if err != nil || !f.rclose {
+		return err
+	}
+	err = hackpadfs.Remove(f.d.FS, Dotify(f.p))
+	if err != nil {
+		return err
+	}
+	return f.d.droppedXattrs(f.p)
+}
+
+// Sync implements Syncer.Sync.
+func (f *dirFile) Sync() error {
+	return hackpadfs.SyncFile(f.File)
+}
+
 func (f *dirFile) Readdir() ([]p9.DirEntry, error) {
+	return f.ReadDir(-1)
+}
+
+// ReadDir implements DirReader.ReadDir.
+func (f *dirFile) ReadDir(n int) ([]p9.DirEntry, error) {
 	// fi, err := f.File.Readdir(-1)
-	fi, err := hackpadfs.ReadDirFile(f.File, -1)
+	fi, err := hackpadfs.ReadDirFile(f.File, n)
 	if err != nil {
 		return nil, err
 	}
@@ -224,7 +683,7 @@ func (f *dirFile) Readdir() ([]p9.DirEntry, error) {
 		if err != nil {
 			return nil, err
 		}
-		entries = append(entries, infoToEntry(info))
+		entries = append(entries, f.d.infoToEntry(path.Join(f.p, info.Name()), info))
 	}
 	return entries, nil
 }
@@ -0,0 +1,602 @@
+package remount
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/DeedleFake/p9"
+	"github.com/hack-pad/hackpadfs"
+	"github.com/hack-pad/hackpadfs/mem"
+	osfs "github.com/hack-pad/hackpadfs/os"
+	"github.com/ipfs/boxo/files"
+)
+
+func TestToOSFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		mode uint8
+		flag int
+	}{
+		{"read", p9.OREAD, os.O_RDONLY},
+		{"write", p9.OWRITE, os.O_WRONLY},
+		{"rdwr", p9.ORDWR, os.O_RDWR},
+		{"exec", p9.OEXEC, os.O_RDONLY},
+		{"read trunc", p9.OREAD | p9.OTRUNC, os.O_RDONLY | os.O_TRUNC},
+		{"write trunc", p9.OWRITE | p9.OTRUNC, os.O_WRONLY | os.O_TRUNC},
+		{"rdwr trunc", p9.ORDWR | p9.OTRUNC, os.O_RDWR | os.O_TRUNC},
+		{"write cexec", p9.OWRITE | p9.OCEXEC, os.O_WRONLY | syscall.O_CLOEXEC},
+		{"read rclose", p9.OREAD | p9.ORCLOSE, os.O_RDONLY},
+		{"rdwr all", p9.ORDWR | p9.OTRUNC | p9.OCEXEC | p9.ORCLOSE, os.O_RDWR | os.O_TRUNC | syscall.O_CLOEXEC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toOSFlags(tt.mode); got != tt.flag {
+				t.Errorf("toOSFlags(%#x) = %#x, want %#x", tt.mode, got, tt.flag)
+			}
+		})
+	}
+}
+
+func TestFromOSFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		flag int
+		mode uint8
+	}{
+		{"read", os.O_RDONLY, p9.OREAD},
+		{"write", os.O_WRONLY, p9.OWRITE},
+		{"rdwr", os.O_RDWR, p9.ORDWR},
+		{"write trunc", os.O_WRONLY | os.O_TRUNC, p9.OWRITE | p9.OTRUNC},
+		{"rdwr trunc", os.O_RDWR | os.O_TRUNC, p9.ORDWR | p9.OTRUNC},
+		{"cloexec", os.O_RDONLY | syscall.O_CLOEXEC, p9.OREAD | p9.OCEXEC},
+		{"create dropped", os.O_WRONLY | os.O_CREATE, p9.OWRITE},
+		{"excl dropped", os.O_RDWR | os.O_CREATE | os.O_EXCL, p9.ORDWR},
+		{"append dropped", os.O_WRONLY | os.O_APPEND, p9.OWRITE},
+		{"sync dropped", os.O_RDWR | os.O_SYNC, p9.ORDWR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fromOSFlags(tt.flag); got != tt.mode {
+				t.Errorf("fromOSFlags(%#x) = %#x, want %#x", tt.flag, got, tt.mode)
+			}
+		})
+	}
+}
+
+func TestFlagsRoundTrip(t *testing.T) {
+	for _, acc := range []int{os.O_RDONLY, os.O_WRONLY, os.O_RDWR} {
+		for _, trunc := range []int{0, os.O_TRUNC} {
+			for _, cexec := range []int{0, syscall.O_CLOEXEC} {
+				flag := acc | trunc | cexec
+				if got := toOSFlags(fromOSFlags(flag)); got != flag {
+					t.Errorf("round trip of %#x gave %#x", flag, got)
+				}
+			}
+		}
+	}
+}
+
+func newTestFS(t *testing.T) *mem.FS {
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "f", []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestFSWOpenFile(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		flag int
+		err  error
+		want string
+	}{
+		{"open existing", "f", os.O_RDONLY, nil, "hello"},
+		{"open missing", "g", os.O_RDONLY, fs.ErrNotExist, ""},
+		{"create existing", "f", os.O_WRONLY | os.O_CREATE, nil, "world"},
+		{"create missing", "g", os.O_WRONLY | os.O_CREATE, nil, "world"},
+		{"exclusive existing", "f", os.O_WRONLY | os.O_CREATE | os.O_EXCL, fs.ErrExist, ""},
+		{"exclusive missing", "g", os.O_WRONLY | os.O_CREATE | os.O_EXCL, nil, "world"},
+		{"append existing", "f", os.O_WRONLY | os.O_APPEND, nil, "helloworld"},
+		{"append created", "g", os.O_WRONLY | os.O_CREATE | os.O_APPEND, nil, "world"},
+		{"truncate existing", "f", os.O_WRONLY | os.O_TRUNC, nil, "world"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestFS(t)
+			w := FSW{Dir{FS: m}}
+			f, err := w.OpenFile(tt.file, tt.flag, 0644)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("OpenFile: got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if tt.flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+				_, err = hackpadfs.WriteFile(f, []byte("world"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := hackpadfs.ReadFile(m, tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("got contents %q, want %q", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirOpenModes(t *testing.T) {
+	m := newTestFS(t)
+	d := Dir{FS: m}
+
+	_, err := d.Create("f", 0644, p9.OWRITE)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Create of existing file: got %v, want %v", err, fs.ErrExist)
+	}
+
+	f, err := d.Open("f", p9.OREAD|p9.ORCLOSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hackpadfs.Stat(m, "f")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ORCLOSE left file behind: %v", err)
+	}
+
+	f, err = d.Create("a", 0644|p9.ModeAppend, p9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"one", "two"} {
+		_, err = f.WriteAt([]byte(s), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hackpadfs.ReadFile(m, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "onetwo" {
+		t.Errorf("append-only file: got %q, want %q", b, "onetwo")
+	}
+}
+
+func TestSecretAuthReplay(t *testing.T) {
+	s := SecretAuth("secret")
+	d := Dir{FS: newTestFS(t), Authenticator: s}
+
+	a, err := d.Auth("u", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 64)
+	n, _ := a.ReadAt(nonce, 0)
+	if n == 0 {
+		t.Fatal("afid has no nonce")
+	}
+	resp := s.Respond("u", "", nonce[:n])
+	_, err = a.WriteAt(resp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Attach(a, "u", "")
+	if err != nil {
+		t.Fatalf("Attach with fresh response: %v", err)
+	}
+
+	b, err := d.Auth("u", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.WriteAt(resp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Attach(b, "u", "")
+	if !errors.Is(err, ErrAuth) {
+		t.Errorf("Attach with replayed response: got %v, want %v", err, ErrAuth)
+	}
+
+	_, err = b.WriteAt([]byte("x"), 1<<40)
+	if err == nil {
+		t.Error("WriteAt far past the end of an afid succeeded")
+	}
+}
+
+func TestDirSearchPerm(t *testing.T) {
+	m := newTestFS(t)
+	err := hackpadfs.Mkdir(m, "priv", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "priv/f", []byte("secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := &ACL{Owners: map[string][2]string{
+		".":    {"root", "root"},
+		"priv": {"alice", "alice"},
+	}}
+	err = hackpadfs.Chmod(m, ".", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{"alice", "bob"} {
+		a, err := Dir{FS: m, Perms: acl}.Attach(nil, u, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := a.Open("priv/f", p9.OREAD)
+		if err == nil {
+			f.Close()
+		}
+		if want := u == "alice"; (err == nil) != want {
+			t.Errorf("%s opening priv/f: got %v", u, err)
+		}
+	}
+
+	a, err := Dir{FS: m, Perms: acl}.Attach(nil, "bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Remove("priv/f")
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("bob removing priv/f: got %v, want %v", err, fs.ErrPermission)
+	}
+}
+
+func TestDirRenameExisting(t *testing.T) {
+	m := newTestFS(t)
+	err := hackpadfs.WriteFullFile(m, "g", []byte("other"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Dir{FS: m}
+
+	c := noChanges()
+	c.EntryName = "g"
+	err = d.WriteStat("f", c)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("wstat onto existing name: got %v, want %v", err, fs.ErrExist)
+	}
+
+	err = d.Rename("f", "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hackpadfs.ReadFile(m, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("Rename did not replace target: got %q", b)
+	}
+}
+
+func TestDirStatSymlink(t *testing.T) {
+	dir := t.TempDir()
+	err := os.Symlink("nowhere", dir+"/l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := osfs.NewFS().Sub(dir[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Dir{FS: s}
+
+	e, err := d.Stat("l")
+	if err != nil {
+		t.Fatalf("Stat of dangling symlink: %v", err)
+	}
+	if e.FileMode&p9.ModeSymlink == 0 {
+		t.Errorf("Stat of symlink: got mode %v", e.FileMode)
+	}
+	q, err := d.GetQID("l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Type != p9.QTSymlink {
+		t.Errorf("GetQID of symlink: got type %#x, want %#x", q.Type, p9.QTSymlink)
+	}
+}
+
+func TestDirCreateSymlink(t *testing.T) {
+	s, err := osfs.NewFS().Sub(t.TempDir()[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Dir{FS: s}
+
+	f, err := d.Create("l", p9.ModeSymlink|0777, p9.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := d.GetQID("l")
+	if err != nil {
+		t.Fatalf("GetQID of new symlink: %v", err)
+	}
+	if q.Type != p9.QTSymlink {
+		t.Errorf("GetQID of new symlink: got type %#x, want %#x", q.Type, p9.QTSymlink)
+	}
+	_, err = f.WriteAt([]byte("target"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.Readlink("l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Base(l) != "target" {
+		t.Errorf("Readlink: got %q, want target", l)
+	}
+}
+
+func TestIpfsRoot(t *testing.T) {
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.Mkdir(m, "d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "d/f", []byte("hi"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, y := range []string{".", ""} {
+		n, err := Ipfs(m, y)
+		if err != nil {
+			t.Fatalf("Ipfs(%q): %v", y, err)
+		}
+		var got []string
+		err = files.Walk(n, func(p string, _ files.Node) error {
+			got = append(got, p)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Ipfs(%q): walk: %v", y, err)
+		}
+		want := []string{"", "d", "d/f"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Ipfs(%q): got %q, want %q", y, got, want)
+		}
+	}
+}
+
+func TestCowIpfsRoot(t *testing.T) {
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.MkdirAll(m, "c/d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "c/d/f", []byte("hi"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := hackpadfs.Sub(m, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewCow(s, l)
+	err = hackpadfs.WriteFullFile(w, "g", []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Ipfs(w, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = files.Walk(n, func(p string, _ files.Node) error {
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	want := []string{"", "d", "d/f", "g"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// fifoFS is an os FS that can make FIFOs.
+type fifoFS struct {
+	*osfs.FS
+	root string
+}
+
+func (f fifoFS) Mknod(name string, mode fs.FileMode, dev int) error {
+	if mode&fs.ModeNamedPipe == 0 {
+		return syscall.EPERM
+	}
+	return syscall.Mkfifo(path.Join(f.root, name), uint32(mode.Perm()))
+}
+
+func TestDirCreateFifo(t *testing.T) {
+	root := t.TempDir()
+	s, err := osfs.NewFS().Sub(root[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Dir{FS: fifoFS{s.(*osfs.FS), root}}
+
+	// Opening a FIFO for writing blocks until there is a reader, so
+	// Create must not open it.
+	done := make(chan error, 1)
+	go func() {
+		f, err := d.Create("p", p9.ModeNamedPipe|0644, p9.OWRITE)
+		if err == nil {
+			err = f.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Create of a FIFO blocked")
+	}
+	fi, err := os.Lstat(path.Join(root, "p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeNamedPipe == 0 {
+		t.Errorf("got mode %v, want a FIFO", fi.Mode())
+	}
+}
+
+func TestMultiDirPrefix(t *testing.T) {
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "x", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.MkdirAll(m, "b", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "b/x", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := NewMultiDir()
+	md.Register("a", Dir{FS: m})
+	a, err := md.Attach(nil, "", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"a", "/a", "a/x", "a/b/x"} {
+		_, err := a.Stat(p)
+		if err != nil {
+			t.Errorf("Stat(%q): %v", p, err)
+		}
+	}
+	// ab/x is not a/b/x, and x is not under a at all.
+	for _, p := range []string{"ab/x", "x", "b/x"} {
+		_, err := a.Stat(p)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%q): got %v, want ErrNotExist", p, err)
+		}
+	}
+}
+
+func TestDirXattrsFollowFiles(t *testing.T) {
+	m, err := mem.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := Dir{FS: m, Xattrs: NewMemXattrs()}
+	for _, p := range []string{"a", "b", "c"} {
+		err = hackpadfs.WriteFullFile(m, p, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.SetXattr(p, "user.x", []byte(p), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = hackpadfs.MkdirAll(m, "d", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "d/f", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetXattr("d/f", "user.x", []byte("d/f"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file created where another was removed starts out bare.
+	err = d.Remove("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hackpadfs.WriteFullFile(m, "a", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renames carry attributes along, replacing the target's, and
+	// take those of a directory's contents too.
+	err = d.Rename("b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Rename("d", "e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]string{"a": "", "c": "b", "e/f": "d/f"} {
+		v, err := d.GetXattr(p, "user.x")
+		switch {
+		case want == "" && !errors.Is(err, ErrNoXattr):
+			t.Errorf("%s: got %q, %v, want ErrNoXattr", p, v, err)
+		case want != "" && (err != nil || string(v) != want):
+			t.Errorf("%s: got %q, %v, want %q", p, v, err, want)
+		}
+	}
+}
+
+func TestIXattrRoot(t *testing.T) {
+	for _, p := range []string{".", "ipfs", "ipns"} {
+		_, err := I{}.GetXattr(p, XattrCID)
+		if xattrErr(err) != fuse.ErrNoXattr {
+			t.Errorf("GetXattr(%q): got %v, want ENODATA", p, err)
+		}
+	}
+}
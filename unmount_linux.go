@@ -0,0 +1,22 @@
+package remount
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// lazyUnmount detaches dir even while it is busy. Unprivileged users go
+// through fusermount.
+func lazyUnmount(dir string) error {
+	err := syscall.Unmount(dir, syscall.MNT_DETACH)
+	if err == nil {
+		return nil
+	}
+	out, err := exec.Command("fusermount", "-u", "-z", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fusermount: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
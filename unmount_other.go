@@ -0,0 +1,11 @@
+//go:build !linux
+
+package remount
+
+import "golang.org/x/sys/unix"
+
+// lazyUnmount forces dir off even while it is busy, as there is no lazy
+// unmount outside Linux.
+func lazyUnmount(dir string) error {
+	return unix.Unmount(dir, unix.MNT_FORCE)
+}
@@ -1,8 +1,12 @@
 package remount
 
 import (
+	"errors"
 	"io"
 	"io/fs"
+	gopath "path"
+	"syscall"
+	"time"
 
 	"github.com/hack-pad/hackpadfs"
 	"github.com/tetratelabs/wazero"
@@ -14,7 +18,9 @@ import (
 var WazFlags = map[experimentalsys.Oflag]int{
 	experimentalsys.O_APPEND: hackpadfs.FlagAppend,
 	experimentalsys.O_CREAT:  hackpadfs.FlagCreate,
+	experimentalsys.O_EXCL:   hackpadfs.FlagExclusive,
 	experimentalsys.O_RDONLY: hackpadfs.FlagReadOnly,
+	experimentalsys.O_RDWR:   hackpadfs.FlagReadWrite,
 	experimentalsys.O_WRONLY: hackpadfs.FlagWriteOnly,
 	experimentalsys.O_SYNC:   hackpadfs.FlagSync,
 	experimentalsys.O_TRUNC:  hackpadfs.FlagTruncate,
@@ -40,28 +46,62 @@ func GetSysFlag(x int) experimentalsys.Oflag {
 	return f
 }
 
+// WazAdapt translates a Go filesystem error into the closest WASI errno.
+// Wrapped errors (*fs.PathError, *hackpadfs.LinkError and friends) are
+// unwrapped first; io.EOF is not an error as far as WASI is concerned.
 func WazAdapt(err error) experimentalsys.Errno {
-	if err != nil {
+	if err == nil || errors.Is(err, io.EOF) {
+		return 0
+	}
+	var errno experimentalsys.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	var serr syscall.Errno
+	if errors.As(err, &serr) {
+		return experimentalsys.UnwrapOSError(serr)
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return experimentalsys.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return experimentalsys.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return experimentalsys.EACCES
+	case errors.Is(err, fs.ErrClosed):
 		return experimentalsys.EBADF
+	case errors.Is(err, fs.ErrInvalid):
+		return experimentalsys.EINVAL
 	}
-	return 0
+	return experimentalsys.EIO
 }
 func WithHackpadFS(x wazero.FSConfig, d string, fs hackpadfs.FS) wazero.FSConfig {
-	return x.(sysfs.FSConfig).WithSysFSMount(&WazFS{fs}, d)
+	return x.(sysfs.FSConfig).WithSysFSMount(&WazFS{FS: fs, Inodes: NewHashInodes()}, d)
 }
 
 type WazFS struct {
 	hackpadfs.FS
+	// Inodes numbers the files seen by the guest. If nil, paths are
+	// hashed.
+	Inodes Inodes
+}
+
+func (w WazFS) stat(path string, a fs.FileInfo) sys.Stat_t {
+	s := sys.NewStat_t(a)
+	i := inodes(w.Inodes)
+	s.Ino = i.Ino(path)
+	s.Dev = i.Dev()
+	return s
 }
 
 // Chmod implements sys.FS.
-func (WazFS) Chmod(path string, perm fs.FileMode) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Chmod(path string, perm fs.FileMode) experimentalsys.Errno {
+	return WazAdapt(hackpadfs.Chmod(w.FS, path, perm))
 }
 
 // Link implements sys.FS.
-func (WazFS) Link(oldPath string, newPath string) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Link(oldPath string, newPath string) experimentalsys.Errno {
+	return WazAdapt(Link(w.FS, oldPath, newPath))
 }
 
 // Lstat implements sys.FS.
@@ -70,12 +110,12 @@ func (w WazFS) Lstat(path string) (sys.Stat_t, experimentalsys.Errno) {
 	if err != nil {
 		return sys.Stat_t{}, WazAdapt(err)
 	}
-	return sys.NewStat_t(a), 0
+	return w.stat(path, a), 0
 }
 
 // Mkdir implements sys.FS.
-func (WazFS) Mkdir(path string, perm fs.FileMode) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Mkdir(path string, perm fs.FileMode) experimentalsys.Errno {
+	return WazAdapt(hackpadfs.Mkdir(w.FS, path, perm))
 }
 
 // OpenFile implements sys.FS.
@@ -99,18 +139,29 @@ func (w *WazFS) OpenFile(path string, flag experimentalsys.Oflag, perm fs.FileMo
 }
 
 // Readlink implements sys.FS.
-func (WazFS) Readlink(path string) (string, experimentalsys.Errno) {
-	panic("unimplemented")
+func (w WazFS) Readlink(path string) (string, experimentalsys.Errno) {
+	s, err := Readlink(w.FS, path)
+	if err != nil {
+		return "", WazAdapt(err)
+	}
+	return s, 0
 }
 
 // Rename implements sys.FS.
-func (WazFS) Rename(from string, to string) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Rename(from string, to string) experimentalsys.Errno {
+	return WazAdapt(hackpadfs.Rename(w.FS, from, to))
 }
 
 // Rmdir implements sys.FS.
-func (WazFS) Rmdir(path string) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Rmdir(path string) experimentalsys.Errno {
+	s, err := hackpadfs.LstatOrStat(w.FS, path)
+	if err != nil {
+		return WazAdapt(err)
+	}
+	if !s.IsDir() {
+		return experimentalsys.ENOTDIR
+	}
+	return WazAdapt(hackpadfs.Remove(w.FS, path))
 }
 
 // Stat implements sys.FS.
@@ -119,22 +170,46 @@ func (w WazFS) Stat(path string) (sys.Stat_t, experimentalsys.Errno) {
 	if err != nil {
 		return sys.Stat_t{}, WazAdapt(err)
 	}
-	return sys.NewStat_t(a), 0
+	return w.stat(path, a), 0
 }
 
 // Symlink implements sys.FS.
-func (WazFS) Symlink(oldPath string, linkName string) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Symlink(oldPath string, linkName string) experimentalsys.Errno {
+	return WazAdapt(hackpadfs.Symlink(w.FS, oldPath, linkName))
 }
 
 // Unlink implements sys.FS.
-func (WazFS) Unlink(path string) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Unlink(path string) experimentalsys.Errno {
+	s, err := hackpadfs.LstatOrStat(w.FS, path)
+	if err != nil {
+		return WazAdapt(err)
+	}
+	if s.IsDir() {
+		return experimentalsys.EISDIR
+	}
+	return WazAdapt(hackpadfs.Remove(w.FS, path))
 }
 
 // Utimens implements sys.FS.
-func (WazFS) Utimens(path string, atim int64, mtim int64) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFS) Utimens(path string, atim int64, mtim int64) experimentalsys.Errno {
+	s, err := hackpadfs.Stat(w.FS, path)
+	if err != nil {
+		return WazAdapt(err)
+	}
+	a, m := wazTimes(s, atim, mtim)
+	return WazAdapt(hackpadfs.Chtimes(w.FS, path, a, m))
+}
+
+// wazTimes resolves UTIME_OMIT against the current times in s.
+func wazTimes(s fs.FileInfo, atim int64, mtim int64) (time.Time, time.Time) {
+	st := sys.NewStat_t(s)
+	if atim == experimentalsys.UTIME_OMIT {
+		atim = st.Atim
+	}
+	if mtim == experimentalsys.UTIME_OMIT {
+		mtim = st.Mtim
+	}
+	return time.Unix(0, atim), time.Unix(0, mtim)
 }
 
 var _ experimentalsys.FS = &WazFS{}
@@ -169,12 +244,12 @@ func (w WazFile) Datasync() experimentalsys.Errno {
 
 // Dev implements sys.File.
 func (w WazFile) Dev() (uint64, experimentalsys.Errno) {
-	return 0, 0
+	return inodes(w.In.FS.Inodes).Dev(), 0
 }
 
 // Ino implements sys.File.
-func (WazFile) Ino() (uint64, experimentalsys.Errno) {
-	return 0, 0
+func (w WazFile) Ino() (uint64, experimentalsys.Errno) {
+	return inodes(w.In.FS.Inodes).Ino(w.In.Path), 0
 }
 
 // IsAppend implements sys.File.
@@ -198,10 +273,7 @@ func (w WazFile) Pread(buf []byte, off int64) (n int, errno experimentalsys.Errn
 		return 0, WazAdapt(err)
 	}
 	a, err := w.B.Read(buf)
-	if err != nil {
-		return 0, WazAdapt(err)
-	}
-	return a, 0
+	return a, WazAdapt(err)
 }
 
 // Pwrite implements sys.File.
@@ -220,10 +292,7 @@ func (w WazFile) Pwrite(buf []byte, off int64) (n int, errno experimentalsys.Err
 // Read implements sys.File.
 func (w WazFile) Read(buf []byte) (n int, errno experimentalsys.Errno) {
 	a, err := w.B.Read(buf)
-	if err != nil {
-		return 0, WazAdapt(err)
-	}
-	return a, 0
+	return a, WazAdapt(err)
 }
 
 // Readdir implements sys.File.
@@ -232,9 +301,10 @@ func (w WazFile) Readdir(n int) (dirents []experimentalsys.Dirent, errno experim
 	if err != nil {
 		return nil, WazAdapt(err)
 	}
+	i := inodes(w.In.FS.Inodes)
 	b := []experimentalsys.Dirent{}
 	for _, c := range a {
-		b = append(b, experimentalsys.Dirent{Ino: 0, Name: c.Name(), Type: c.Mode().Type()})
+		b = append(b, experimentalsys.Dirent{Ino: i.Ino(gopath.Join(w.In.Path, c.Name())), Name: c.Name(), Type: c.Mode().Type()})
 	}
 	return b, 0
 }
@@ -265,7 +335,7 @@ func (w WazFile) Stat() (sys.Stat_t, experimentalsys.Errno) {
 	if err != nil {
 		return sys.Stat_t{}, WazAdapt(err)
 	}
-	return sys.NewStat_t(a), 0
+	return w.In.FS.stat(w.In.Path, a), 0
 }
 
 // Sync implements sys.File.
@@ -279,8 +349,17 @@ func (w WazFile) Truncate(size int64) experimentalsys.Errno {
 }
 
 // Utimens implements sys.File.
-func (WazFile) Utimens(atim int64, mtim int64) experimentalsys.Errno {
-	panic("unimplemented")
+func (w WazFile) Utimens(atim int64, mtim int64) experimentalsys.Errno {
+	s, err := w.B.Stat()
+	if err != nil {
+		return WazAdapt(err)
+	}
+	a, m := wazTimes(s, atim, mtim)
+	err = hackpadfs.ChtimesFile(w.B.File, a, m)
+	if errors.Is(err, hackpadfs.ErrNotImplemented) {
+		err = hackpadfs.Chtimes(w.In.FS.FS, w.In.Path, a, m)
+	}
+	return WazAdapt(err)
 }
 
 // Write implements sys.File.
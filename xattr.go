@@ -0,0 +1,383 @@
+package remount
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hack-pad/hackpadfs"
+)
+
+// ErrNoXattr is returned for extended attributes that are not set.
+var ErrNoXattr = errors.New("no such extended attribute")
+
+// Flags for XattrFS.SetXattr, with their Linux values.
+const (
+	XattrCreate  = 1
+	XattrReplace = 2
+)
+
+// XattrFS is implemented by hackpadfs trees that can store extended
+// attributes.
+type XattrFS interface {
+	GetXattr(name, attr string) ([]byte, error)
+	SetXattr(name, attr string, value []byte, flags int) error
+	ListXattr(name string) ([]string, error)
+	RemoveXattr(name, attr string) error
+}
+
+// XattrMover is implemented by XattrFS stores that keep attributes by
+// path beside the tree, so that Dir can carry them along when a file is
+// renamed and drop them when it is removed.
+type XattrMover interface {
+	MoveXattrs(oldname, newname string) error
+	DropXattrs(name string) error
+}
+
+// MemXattrs keeps extended attributes for trees that have no native
+// support for them. Attributes belong to paths, so Dir moves and drops
+// them along with the files. It knows nothing of the tree, so it is up to
+// the caller, as Dir does, to check that the file exists.
+type MemXattrs struct {
+	mtx sync.Mutex
+	m   map[string]map[string][]byte
+
+	fs   hackpadfs.FS
+	name string
+}
+
+func NewMemXattrs() *MemXattrs {
+	return &MemXattrs{m: map[string]map[string][]byte{}}
+}
+
+// NewSidecarXattrs is MemXattrs saved to the file name inside fs after
+// every change, and loaded from it if it already exists. fs should not be
+// the tree being served, or clients could read and rewrite the file.
+func NewSidecarXattrs(fs hackpadfs.FS, name string) (*MemXattrs, error) {
+	x := NewMemXattrs()
+	x.fs, x.name = fs, name
+	b, err := hackpadfs.ReadFile(fs, name)
+	switch {
+	case errors.Is(err, hackpadfs.ErrNotExist):
+		return x, nil
+	case err != nil:
+		return nil, err
+	}
+	err = json.Unmarshal(b, &x.m)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func xattrKey(name string) string {
+	return Dotify(path.Clean("/" + name))
+}
+
+func (x *MemXattrs) GetXattr(name, attr string) ([]byte, error) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	v, ok := x.m[xattrKey(name)][attr]
+	if !ok {
+		return nil, ErrNoXattr
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (x *MemXattrs) SetXattr(name, attr string, value []byte, flags int) error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	k := xattrKey(name)
+	_, ok := x.m[k][attr]
+	switch {
+	case ok && flags&XattrCreate != 0:
+		return fs.ErrExist
+	case !ok && flags&XattrReplace != 0:
+		return ErrNoXattr
+	}
+	if x.m[k] == nil {
+		x.m[k] = map[string][]byte{}
+	}
+	x.m[k][attr] = append([]byte(nil), value...)
+	return x.save()
+}
+
+func (x *MemXattrs) ListXattr(name string) ([]string, error) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	a := make([]string, 0, len(x.m[xattrKey(name)]))
+	for k := range x.m[xattrKey(name)] {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a, nil
+}
+
+func (x *MemXattrs) RemoveXattr(name, attr string) error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	k := xattrKey(name)
+	if _, ok := x.m[k][attr]; !ok {
+		return ErrNoXattr
+	}
+	delete(x.m[k], attr)
+	if len(x.m[k]) == 0 {
+		delete(x.m, k)
+	}
+	return x.save()
+}
+
+// under reports whether key is name or inside it.
+func under(key, name string) bool {
+	return key == name || name == "." || strings.HasPrefix(key, name+"/")
+}
+
+// MoveXattrs moves the attributes of oldname, and of everything inside
+// it, to newname, replacing those already there.
+func (x *MemXattrs) MoveXattrs(oldname, newname string) error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	o, n := xattrKey(oldname), xattrKey(newname)
+	if o == n {
+		return nil
+	}
+	for k := range x.m {
+		if under(k, n) && !under(k, o) {
+			delete(x.m, k)
+		}
+	}
+	m := map[string]map[string][]byte{}
+	for k, v := range x.m {
+		if under(k, o) {
+			m[n+k[len(o):]] = v
+			delete(x.m, k)
+		}
+	}
+	for k, v := range m {
+		x.m[k] = v
+	}
+	return x.save()
+}
+
+// DropXattrs forgets the attributes of name and of everything inside it.
+func (x *MemXattrs) DropXattrs(name string) error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	n := xattrKey(name)
+	for k := range x.m {
+		if under(k, n) {
+			delete(x.m, k)
+		}
+	}
+	return x.save()
+}
+
+func (x *MemXattrs) save() error {
+	if x.fs == nil {
+		return nil
+	}
+	b, err := json.Marshal(x.m)
+	if err != nil {
+		return err
+	}
+	return hackpadfs.WriteFullFile(x.fs, x.name, b, 0600)
+}
+
+var _ XattrFS = &MemXattrs{}
+var _ XattrMover = &MemXattrs{}
+
+// SubXattrs is an XattrFS rooted at Dir inside another one, to go with
+// hackpadfs.Sub.
+type SubXattrs struct {
+	XattrFS
+	Dir string
+}
+
+func (s SubXattrs) join(name string) string {
+	return Dotify(path.Join(s.Dir, name))
+}
+
+func (s SubXattrs) GetXattr(name, attr string) ([]byte, error) {
+	return s.XattrFS.GetXattr(s.join(name), attr)
+}
+
+func (s SubXattrs) SetXattr(name, attr string, value []byte, flags int) error {
+	return s.XattrFS.SetXattr(s.join(name), attr, value, flags)
+}
+
+func (s SubXattrs) ListXattr(name string) ([]string, error) {
+	return s.XattrFS.ListXattr(s.join(name))
+}
+
+func (s SubXattrs) RemoveXattr(name, attr string) error {
+	return s.XattrFS.RemoveXattr(s.join(name), attr)
+}
+
+func (s SubXattrs) MoveXattrs(oldname, newname string) error {
+	m, ok := s.XattrFS.(XattrMover)
+	if !ok {
+		return nil
+	}
+	return m.MoveXattrs(s.join(oldname), s.join(newname))
+}
+
+func (s SubXattrs) DropXattrs(name string) error {
+	m, ok := s.XattrFS.(XattrMover)
+	if !ok {
+		return nil
+	}
+	return m.DropXattrs(s.join(name))
+}
+
+// XattrCID is the read-only attribute I uses to expose the CID of a file.
+const XattrCID = "user.ipfs.cid"
+
+// nodeless tells whether name is one of the directories I serves with no
+// node, and so no CID, behind them.
+func nodeless(name string) bool {
+	switch strings.Trim(name, "/") {
+	case "", ".", "ipfs", "ipns":
+		return true
+	}
+	return false
+}
+
+func (i I) GetXattr(name, attr string) ([]byte, error) {
+	if attr != XattrCID {
+		return nil, ErrNoXattr
+	}
+	if nodeless(name) {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: syscall.ENODATA}
+	}
+	p, err := ipath(name)
+	if err != nil {
+		return nil, err
+	}
+	n, err := i.ResolveNode(context.Background(), p)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(n.Cid().String()), nil
+}
+
+func (i I) SetXattr(name, attr string, value []byte, flags int) error {
+	return &fs.PathError{Op: "setxattr", Path: name, Err: fs.ErrPermission}
+}
+
+func (i I) ListXattr(name string) ([]string, error) {
+	if nodeless(name) {
+		return nil, nil
+	}
+	return []string{XattrCID}, nil
+}
+
+func (i I) RemoveXattr(name, attr string) error {
+	return &fs.PathError{Op: "removexattr", Path: name, Err: fs.ErrPermission}
+}
+
+var _ XattrFS = I{}
+
+// xattrs returns where the attributes of p are kept, once p is known to
+// exist.
+func (d Dir) xattrs(p string) (XattrFS, error) {
+	x, ok := d.FS.(XattrFS)
+	if !ok {
+		x = d.Xattrs
+	}
+	if x == nil {
+		return nil, &fs.PathError{Op: "xattr", Path: p, Err: syscall.ENOTSUP}
+	}
+	_, err := hackpadfs.LstatOrStat(d.FS, Dotify(p))
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// xattrMover returns the store to keep in step with renames and removes,
+// if attributes are kept by path beside the tree.
+func (d Dir) xattrMover() XattrMover {
+	if _, ok := d.FS.(XattrFS); ok {
+		return nil
+	}
+	m, _ := d.Xattrs.(XattrMover)
+	return m
+}
+
+// movedXattrs carries attributes along after oldp was renamed to newp.
+func (d Dir) movedXattrs(oldp, newp string) error {
+	m := d.xattrMover()
+	if m == nil {
+		return nil
+	}
+	return m.MoveXattrs(Dotify(oldp), Dotify(newp))
+}
+
+// droppedXattrs forgets attributes after p was removed.
+func (d Dir) droppedXattrs(p string) error {
+	m := d.xattrMover()
+	if m == nil {
+		return nil
+	}
+	return m.DropXattrs(Dotify(p))
+}
+
+// GetXattr implements Xattrer.GetXattr.
+func (d Dir) GetXattr(p, attr string) ([]byte, error) {
+	x, err := d.xattrs(p)
+	if err != nil {
+		return nil, err
+	}
+	err = d.access(p, permRead)
+	if err != nil {
+		return nil, err
+	}
+	return x.GetXattr(Dotify(p), attr)
+}
+
+// SetXattr implements Xattrer.SetXattr.
+func (d Dir) SetXattr(p, attr string, value []byte, flags int) error {
+	x, err := d.xattrs(p)
+	if err != nil {
+		return err
+	}
+	err = d.access(p, permWrite)
+	if err != nil {
+		return err
+	}
+	return x.SetXattr(Dotify(p), attr, value, flags)
+}
+
+// ListXattr implements Xattrer.ListXattr.
+func (d Dir) ListXattr(p string) ([]string, error) {
+	x, err := d.xattrs(p)
+	if err != nil {
+		return nil, err
+	}
+	err = d.access(p, permRead)
+	if err != nil {
+		return nil, err
+	}
+	return x.ListXattr(Dotify(p))
+}
+
+// RemoveXattr implements Xattrer.RemoveXattr.
+func (d Dir) RemoveXattr(p, attr string) error {
+	x, err := d.xattrs(p)
+	if err != nil {
+		return err
+	}
+	err = d.access(p, permWrite)
+	if err != nil {
+		return err
+	}
+	return x.RemoveXattr(Dotify(p), attr)
+}
+
+var _ Xattrer = Dir{}